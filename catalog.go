@@ -0,0 +1,561 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+)
+
+// The statuses a family placement can be in
+const (
+	placementActive = "active"
+	// placementMigrating marks a family that is being copied to another shard
+	placementMigrating = "migrating"
+	// placementIncoming marks the copy a migration is making of a family on
+	// the shard it moves the family to. It gets every row written to the
+	// migrating placement, with the same id, but isn't read from or counted
+	// as a replica until the migration switches it to active.
+	placementIncoming = "incoming"
+)
+
+// FamilyPlacement is a row of the placement catalog, recording that a family
+// lives on a shard. Every shard keeps the catalog rows of the families it
+// holds, next to their tables, and the union of them all is the source of
+// truth for where each family lives.
+type FamilyPlacement struct {
+	Family  string `gorm:"primary_key;size:64"`
+	ShardID string `gorm:"primary_key;size:255"`
+	// Schema is the JSON encoded schema map the family was created with
+	Schema    string `gorm:"type:text"`
+	CreatedAt time.Time
+	// RowEstimate is the row count information_schema last reported for the
+	// family table, which is only an estimate for InnoDB
+	RowEstimate int64
+	Status      string `gorm:"size:32"`
+	// Parent is the family a time bucket table belongs to, and Partition is
+	// how that family is split into buckets. Both are empty for families
+	// that aren't partitioned.
+	Parent    string `gorm:"size:64;index"`
+	Partition string `gorm:"size:16"`
+	// BucketStart is the start of the time bucket of a bucket table
+	BucketStart *time.Time
+	// Replicas is the number of shards the family was created on, each
+	// holding all of its rows. Rows from before replication have 0.
+	Replicas int
+}
+
+// errNoSuchTable is the MySQL error for a table that doesn't exist
+const errNoSuchTable = 1146
+
+// errPlacementChanged is returned for a write to a family whose placement
+// on the shard isn't what this instance thought it was, because another
+// instance moved the family or started or finished moving it
+var errPlacementChanged = errors.New("the placement of the family has changed")
+
+// catalog holds the placements of every family known to this instance, keyed
+// by family name
+var (
+	catalog     = map[string][]FamilyPlacement{}
+	catalogLock sync.RWMutex
+)
+
+// loadCatalog reads the catalog rows of every shard into memory
+func loadCatalog() {
+	for _, shard := range connectedShards() {
+		err := loadShardCatalog(shard)
+		if err != nil {
+			logrus.WithError(err).Fatalf("Could not load the placement catalog of %s", shard.ID)
+		}
+	}
+
+	refreshRowEstimates()
+}
+
+// loadShardCatalog reads the catalog rows of a shard into memory, along with
+// whether it is being drained. Family tables that predate the catalog are
+// added to it as they are found.
+func loadShardCatalog(shard Shard) error {
+	err := loadDraining(shard)
+	if err != nil {
+		return err
+	}
+	var placements []FamilyPlacement
+	err = shard.DB.Find(&placements).Error
+	if err != nil {
+		return err
+	}
+	cataloged := map[string]bool{}
+	for _, placement := range placements {
+		if placement.ShardID != shard.ID {
+			// The catalog row lives next to the table it describes, so the
+			// shard it was read from wins over what it says
+			logrus.Warningf("The catalog of %s places the %s family on %s", shard.ID, placement.Family, placement.ShardID)
+			placement.ShardID = shard.ID
+		}
+		cataloged[strings.ToLower(placement.Family)] = true
+		cachePlacement(placement)
+	}
+
+	return adoptTables(shard, cataloged)
+}
+
+// adoptTables adds a catalog row for every family table of the shard that
+// doesn't have one yet, recovering the schema from its columns
+func adoptTables(shard Shard, cataloged map[string]bool) error {
+	rows, err := shard.DB.Raw("SHOW TABLES").Rows()
+	if err != nil {
+		return err
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		err = rows.Scan(&table)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+
+	internal := internalTables()
+	for _, table := range tables {
+		if internal[strings.ToLower(table)] || cataloged[strings.ToLower(table)] {
+			continue
+		}
+
+		columns, err := familyColumns([]queryTarget{{Shard: shard, Tables: []string{table}}})
+		if err != nil {
+			return err
+		}
+		schema := map[string]string{}
+		for column, declared := range columns {
+			if !reservedColumns[column] {
+				schema[column] = declared
+			}
+		}
+
+		logrus.Infof("Adding the existing %s family on %s to the placement catalog", table, shard.ID)
+		err = recordPlacement(shard, FamilyPlacement{Family: table}, schema)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recordPlacement adds a family created on the shard to the catalog. The
+// family name, the status if it isn't active and, for time buckets, the
+// partitioning fields are taken from placement.
+func recordPlacement(shard Shard, placement FamilyPlacement, schema map[string]string) error {
+	encoded, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+	placement.ShardID = shard.ID
+	placement.Schema = string(encoded)
+	if placement.Status == "" {
+		placement.Status = placementActive
+	}
+	err = shard.DB.Create(&placement).Error
+	if err != nil {
+		return err
+	}
+	cachePlacement(placement)
+	return nil
+}
+
+// removePlacement deletes the catalog row placing a family on the shard
+func removePlacement(shard Shard, family string) error {
+	err := shard.DB.Where("family = ? AND shard_id = ?", family, shard.ID).Delete(&FamilyPlacement{}).Error
+	if err != nil {
+		return err
+	}
+	uncachePlacement(shard, family)
+	return nil
+}
+
+// uncachePlacement drops the placement of a family on the shard from the
+// in-memory catalog and the family set of the shard
+func uncachePlacement(shard Shard, family string) {
+	catalogLock.Lock()
+	defer catalogLock.Unlock()
+	var placements []FamilyPlacement
+	for _, placement := range catalog[family] {
+		if placement.ShardID != shard.ID {
+			placements = append(placements, placement)
+		}
+	}
+	if len(placements) == 0 {
+		delete(catalog, family)
+	} else {
+		catalog[family] = placements
+	}
+	shard.Families.Remove(family)
+}
+
+// setPlacementStatus changes the status of the placement of a family on the
+// shard
+func setPlacementStatus(shard Shard, family string, status string) error {
+	err := shard.DB.Model(&FamilyPlacement{}).
+		Where("family = ? AND shard_id = ?", family, shard.ID).
+		Update("status", status).Error
+	if err != nil {
+		return err
+	}
+	cachePlacementStatus(shard.ID, family, status)
+	return nil
+}
+
+// cachePlacementStatus changes the status of the placement of a family on
+// the shard with the given ID in the in-memory catalog
+func cachePlacementStatus(shardID string, family string, status string) {
+	for _, placement := range placementsOf(family) {
+		if placement.ShardID == shardID {
+			placement.Status = status
+			cachePlacement(placement)
+		}
+	}
+}
+
+// cachePlacement adds a placement to the in-memory catalog and the family set
+// of its shard
+func cachePlacement(placement FamilyPlacement) {
+	catalogLock.Lock()
+	defer catalogLock.Unlock()
+
+	// The slice is replaced rather than changed in place, since callers of
+	// placementsOf may still be reading the old one
+	placements := append([]FamilyPlacement(nil), catalog[placement.Family]...)
+	for i, existing := range placements {
+		if existing.ShardID == placement.ShardID {
+			placements[i] = placement
+			catalog[placement.Family] = placements
+			return
+		}
+	}
+	catalog[placement.Family] = append(placements, placement)
+
+	if shard, ok := shardByID(placement.ShardID); ok {
+		shard.Families.Add(placement.Family)
+	}
+}
+
+// placementsOf returns where a family lives. Families this instance hasn't
+// seen yet may have been created by another one, so the catalogs of the
+// shards are checked before concluding the family doesn't exist.
+func placementsOf(family string) []FamilyPlacement {
+	catalogLock.RLock()
+	placements, ok := catalog[family]
+	catalogLock.RUnlock()
+	if ok {
+		return placements
+	}
+
+	for _, shard := range liveShards() {
+		var found []FamilyPlacement
+		err := shard.DB.Where("family = ?", family).Find(&found).Error
+		if err != nil {
+			logrus.WithError(err).Warningf("Could not look up the %s family in the catalog of %s", family, shard.ID)
+			continue
+		}
+		for _, placement := range found {
+			placement.ShardID = shard.ID
+			cachePlacement(placement)
+		}
+	}
+
+	catalogLock.RLock()
+	defer catalogLock.RUnlock()
+	return catalog[family]
+}
+
+// refreshCatalog reads the catalog rows of every live shard back into
+// memory, replacing the placements cached for them. This is how an instance
+// finds out about families other instances have created, moved or dropped,
+// and about shards they are draining. The placements on shards that can't be
+// read stay as they were.
+func refreshCatalog() {
+	refreshed := map[string][]FamilyPlacement{}
+	read := map[string]bool{}
+	for _, shard := range liveShards() {
+		var placements []FamilyPlacement
+		err := loadDraining(shard)
+		if err == nil {
+			err = shard.DB.Find(&placements).Error
+		}
+		if err != nil {
+			logrus.WithError(err).Warningf("Could not refresh the placement catalog of %s", shard.ID)
+			continue
+		}
+		read[shard.ID] = true
+		for _, placement := range placements {
+			placement.ShardID = shard.ID
+			refreshed[placement.Family] = append(refreshed[placement.Family], placement)
+		}
+	}
+
+	catalogLock.Lock()
+	defer catalogLock.Unlock()
+	for family, placements := range catalog {
+		for _, placement := range placements {
+			if !read[placement.ShardID] {
+				refreshed[family] = append(refreshed[family], placement)
+			}
+		}
+	}
+	catalog = refreshed
+
+	for _, shard := range connectedShards() {
+		if !read[shard.ID] {
+			continue
+		}
+		for _, family := range shard.Families.List() {
+			if !onShard(refreshed[family.(string)], shard.ID) {
+				shard.Families.Remove(family)
+			}
+		}
+	}
+	for _, placements := range refreshed {
+		for _, placement := range placements {
+			if shard, ok := shardByID(placement.ShardID); ok {
+				shard.Families.Add(placement.Family)
+			}
+		}
+	}
+}
+
+// onShard reports whether any of the placements is on the shard with the
+// given ID
+func onShard(placements []FamilyPlacement, shardID string) bool {
+	for _, placement := range placements {
+		if placement.ShardID == shardID {
+			return true
+		}
+	}
+	return false
+}
+
+// catalogLoop refreshes the placement catalog every --catalog_refresh
+func catalogLoop() {
+	for {
+		time.Sleep(*catalogRefresh)
+		refreshCatalog()
+	}
+}
+
+// forgetPlacements drops a family from the in-memory catalog, so that it is
+// read back from the shards the next time it is needed. This is done when a
+// shard no longer has the table the catalog places there, which is how a
+// family moved by another instance shows up.
+func forgetPlacements(family string) {
+	catalogLock.Lock()
+	defer catalogLock.Unlock()
+	for _, placement := range catalog[family] {
+		if shard, ok := shardByID(placement.ShardID); ok {
+			shard.Families.Remove(family)
+		}
+	}
+	delete(catalog, family)
+}
+
+// placementMoved reports whether a write failed because the family was moved,
+// or is being moved, by another instance, which calls for reading its
+// placements back from the shards and trying again
+func placementMoved(err error) bool {
+	return err == errPlacementChanged || missingTable(err)
+}
+
+// missingTable reports whether err is MySQL saying a table doesn't exist
+func missingTable(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == errNoSuchTable
+}
+
+// placedOn reports whether a family lives on the shard with the given ID,
+// including a copy a migration is still making there
+func placedOn(family string, shardID string) bool {
+	return onShard(placementsOf(family), shardID)
+}
+
+// readablePlacements leaves out the placements a migration is still copying
+// a family to, which queries must not read
+func readablePlacements(placements []FamilyPlacement) []FamilyPlacement {
+	var readable []FamilyPlacement
+	for _, placement := range placements {
+		if placement.Status != placementIncoming {
+			readable = append(readable, placement)
+		}
+	}
+	return readable
+}
+
+// checkPlacement reads the status of the catalog row of a family on the shard
+// tx runs on, with a shared lock held until tx ends, and fails with
+// errPlacementChanged unless it is the status this instance knows about.
+// Every write to a family goes through it, so that a migration changing the
+// row waits for the writes in flight and every later write sees the change.
+// The catalog of a shard only holds its own families, so the row is found by
+// family alone, like loadShardCatalog does.
+func checkPlacement(tx *gorm.DB, family string, status string) error {
+	table := tx.NewScope(&FamilyPlacement{}).TableName()
+	var current sql.NullString
+	err := tx.Raw(
+		"SELECT status FROM "+quoteIdentifier(table)+" WHERE family = ? LIMIT 1 LOCK IN SHARE MODE",
+		family,
+	).Row().Scan(&current)
+	if err == sql.ErrNoRows || (err == nil && current.String != status) {
+		return errPlacementChanged
+	}
+	return err
+}
+
+// shardByID returns the connected shard with the given ID
+func shardByID(id string) (Shard, bool) {
+	for _, shard := range connectedShards() {
+		if shard.ID == id {
+			return shard, true
+		}
+	}
+	return Shard{}, false
+}
+
+// refreshRowEstimates updates the row estimate of every cataloged family
+// from information_schema, both in memory and in the catalog tables
+func refreshRowEstimates() {
+	for _, shard := range liveShards() {
+		rows, err := shard.DB.Raw("SELECT TABLE_NAME, TABLE_ROWS FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE()").Rows()
+		if err != nil {
+			logrus.WithError(err).Warningf("Could not read the table sizes of %s", shard.ID)
+			continue
+		}
+		estimates := map[string]int64{}
+		for rows.Next() {
+			var table string
+			var estimate *int64
+			err = rows.Scan(&table, &estimate)
+			if err != nil {
+				break
+			}
+			if estimate != nil {
+				estimates[table] = *estimate
+			}
+		}
+		rows.Close()
+		if err != nil {
+			logrus.WithError(err).Warningf("Could not read the table sizes of %s", shard.ID)
+			continue
+		}
+
+		for _, placement := range catalogOf(shard.ID) {
+			estimate, ok := estimates[placement.Family]
+			if !ok || estimate == placement.RowEstimate {
+				continue
+			}
+			placement.RowEstimate = estimate
+			err = shard.DB.Model(&FamilyPlacement{}).
+				Where("family = ? AND shard_id = ?", placement.Family, placement.ShardID).
+				Update("row_estimate", estimate).Error
+			if err != nil {
+				logrus.WithError(err).Warningf("Could not update the row estimate of the %s family on %s", placement.Family, shard.ID)
+			}
+			cachePlacement(placement)
+		}
+	}
+}
+
+// catalogOf returns the placements on the shard with the given ID, or every
+// placement when the ID is empty, ordered by family
+func catalogOf(shardID string) []FamilyPlacement {
+	catalogLock.RLock()
+	defer catalogLock.RUnlock()
+
+	var placements []FamilyPlacement
+	for _, familyPlacements := range catalog {
+		for _, placement := range familyPlacements {
+			if shardID == "" || placement.ShardID == shardID {
+				placements = append(placements, placement)
+			}
+		}
+	}
+	sort.Slice(placements, func(i, j int) bool {
+		if placements[i].Family != placements[j].Family {
+			return placements[i].Family < placements[j].Family
+		}
+		return placements[i].ShardID < placements[j].ShardID
+	})
+	return placements
+}
+
+// placementJSON is how a placement is shown by the admin API
+func placementJSON(placement FamilyPlacement) gin.H {
+	schema := map[string]string{}
+	if placement.Schema != "" {
+		err := json.Unmarshal([]byte(placement.Schema), &schema)
+		if err != nil {
+			logrus.WithError(err).Warningf("The catalog holds an unreadable schema for the %s family", placement.Family)
+		}
+	}
+	shown := gin.H{
+		"family":       placement.Family,
+		"shard_id":     placement.ShardID,
+		"schema":       schema,
+		"created_at":   placement.CreatedAt,
+		"row_estimate": placement.RowEstimate,
+		"status":       placement.Status,
+		"replicas":     placement.replicaCount(),
+	}
+	if placement.Parent != "" {
+		shown["parent"] = placement.Parent
+		shown["partition"] = placement.Partition
+		shown["bucket_start"] = placement.BucketStart
+	}
+	return shown
+}
+
+// ListFamilies is the admin handler listing the placement catalog, optionally
+// narrowed down to a single shard with ?shard=
+func ListFamilies(c *gin.Context) {
+	refreshRowEstimates()
+
+	placements := []gin.H{}
+	for _, placement := range catalogOf(c.Query("shard")) {
+		placements = append(placements, placementJSON(placement))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"families": placements,
+	})
+}
+
+// ShowFamily is the admin handler showing where a single family lives
+func ShowFamily(c *gin.Context) {
+	family := c.Param("family")
+	placements := placementsOf(family)
+	if len(placements) == 0 {
+		c.JSON(http.StatusNotFound, map[string]string{
+			"message": fmt.Sprintf("The %s family is not in the placement catalog", family),
+		})
+		return
+	}
+
+	shown := make([]gin.H, len(placements))
+	for i, placement := range placements {
+		shown[i] = placementJSON(placement)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"family":     family,
+		"placements": shown,
+	})
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+)
+
+// The formats the service can log in
+const (
+	logText = "text"
+	logJSON = "json"
+)
+
+// serviceConfig is the format of --config. Every value is optional, and the
+// flag it corresponds to takes precedence over it when given.
+type serviceConfig struct {
+	// Shards are used when neither --shards_file nor --mysql_address and
+	// --mysql_databases are given
+	Shards    []ShardConfig   `yaml:"shards"`
+	Retention retentionConfig `yaml:"retention"`
+	Limits    limitsConfig    `yaml:"limits"`
+	Auth      authConfig      `yaml:"auth"`
+	Logging   loggingConfig   `yaml:"logging"`
+}
+
+// retentionConfig corresponds to --purge and --retention, and can also keep
+// some families for longer or shorter than the rest
+type retentionConfig struct {
+	Enabled  *bool                    `yaml:"enabled"`
+	Default  *time.Duration           `yaml:"default"`
+	Families map[string]time.Duration `yaml:"families"`
+}
+
+// limitsConfig corresponds to --insert_chunk_size, --query_timeout and
+// --max_query_timeout
+type limitsConfig struct {
+	InsertChunkSize *int           `yaml:"insert_chunk_size"`
+	QueryTimeout    *time.Duration `yaml:"query_timeout"`
+	MaxQueryTimeout *time.Duration `yaml:"max_query_timeout"`
+}
+
+// authConfig corresponds to --api_token and --admin_token
+type authConfig struct {
+	Tokens      []string `yaml:"tokens"`
+	AdminTokens []string `yaml:"admin_tokens"`
+}
+
+// loggingConfig corresponds to --log_level and --log_format
+type loggingConfig struct {
+	Level  *string `yaml:"level"`
+	Format *string `yaml:"format"`
+}
+
+// settings are the values that can be changed by reloading --config while
+// the service runs. Requests read them once, so a reload never changes them
+// part way through a request.
+type settings struct {
+	InsertChunkSize int
+	QueryTimeout    time.Duration
+	MaxQueryTimeout time.Duration
+	Purge           bool
+	Retention       time.Duration
+	FamilyRetention map[string]time.Duration
+	APITokens       []string
+	AdminTokens     []string
+	LogLevel        logrus.Level
+	LogFormat       string
+}
+
+var (
+	current     settings
+	currentLock sync.RWMutex
+	// userFlags holds the names of the flags given on the command line,
+	// which the config file can't override
+	userFlags map[string]bool
+	// loadedConfig is the config file as it was last loaded
+	loadedConfig serviceConfig
+)
+
+// currentSettings returns the settings in effect
+func currentSettings() settings {
+	currentLock.RLock()
+	defer currentLock.RUnlock()
+	return current
+}
+
+// flagsSetByUser returns the names of the flags given on the command line
+func flagsSetByUser(args []string) (map[string]bool, error) {
+	context, err := cli.ParseContext(args)
+	if err != nil {
+		return nil, err
+	}
+	given := map[string]bool{}
+	for _, element := range context.Elements {
+		if flag, ok := element.Clause.(*kingpin.FlagClause); ok {
+			given[flag.Model().Name] = true
+		}
+	}
+	return given, nil
+}
+
+// loadConfig reads and checks --config, or returns an empty config when it
+// isn't given
+func loadConfig() (serviceConfig, error) {
+	var config serviceConfig
+	if *configFile == "" {
+		return config, nil
+	}
+	contents, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		return config, err
+	}
+	err = yaml.Unmarshal(contents, &config)
+	if err != nil {
+		return config, fmt.Errorf("could not parse %s: %s", *configFile, err)
+	}
+
+	if len(config.Shards) > 0 {
+		shards := make([]ShardConfig, len(config.Shards))
+		for i, shard := range config.Shards {
+			shards[i] = shard.withDefaults()
+		}
+		err = validateTopology(shards)
+		if err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+// resolveSettings works out the settings from the config file and the flags,
+// and checks them
+func resolveSettings(config serviceConfig) (settings, error) {
+	resolved := settings{
+		InsertChunkSize: *insertChunkSize,
+		QueryTimeout:    *queryTimeout,
+		MaxQueryTimeout: *maxQueryTimeout,
+		Purge:           *purge,
+		Retention:       *retention,
+		FamilyRetention: config.Retention.Families,
+		APITokens:       *apiTokens,
+		AdminTokens:     *adminTokens,
+		LogFormat:       *logFormat,
+	}
+	level := *logLevel
+
+	if config.Retention.Enabled != nil && !userFlags["purge"] {
+		resolved.Purge = *config.Retention.Enabled
+	}
+	if config.Retention.Default != nil && !userFlags["retention"] {
+		resolved.Retention = *config.Retention.Default
+	}
+	if config.Limits.InsertChunkSize != nil && !userFlags["insert_chunk_size"] {
+		resolved.InsertChunkSize = *config.Limits.InsertChunkSize
+	}
+	if config.Limits.QueryTimeout != nil && !userFlags["query_timeout"] {
+		resolved.QueryTimeout = *config.Limits.QueryTimeout
+	}
+	if config.Limits.MaxQueryTimeout != nil && !userFlags["max_query_timeout"] {
+		resolved.MaxQueryTimeout = *config.Limits.MaxQueryTimeout
+	}
+	if !userFlags["api_token"] && !userFlags["admin_token"] {
+		if config.Auth.Tokens != nil || config.Auth.AdminTokens != nil {
+			resolved.APITokens = config.Auth.Tokens
+			resolved.AdminTokens = config.Auth.AdminTokens
+		}
+	}
+	if config.Logging.Level != nil && !userFlags["log_level"] {
+		level = *config.Logging.Level
+	}
+	if config.Logging.Format != nil && !userFlags["log_format"] {
+		resolved.LogFormat = *config.Logging.Format
+	}
+
+	if resolved.InsertChunkSize < 1 {
+		return resolved, fmt.Errorf("the insert chunk size must be at least 1")
+	}
+	if resolved.QueryTimeout <= 0 || resolved.MaxQueryTimeout < resolved.QueryTimeout {
+		return resolved, fmt.Errorf("the query timeout must be positive and at most the maximum query timeout")
+	}
+	if resolved.Retention <= 0 {
+		return resolved, fmt.Errorf("the retention must be positive")
+	}
+	for family, kept := range resolved.FamilyRetention {
+		if kept <= 0 {
+			return resolved, fmt.Errorf("the retention of the %s family must be positive", family)
+		}
+	}
+	for _, token := range append(append([]string(nil), resolved.APITokens...), resolved.AdminTokens...) {
+		if strings.TrimSpace(token) == "" {
+			return resolved, fmt.Errorf("tokens can't be empty")
+		}
+	}
+	var err error
+	resolved.LogLevel, err = logrus.ParseLevel(level)
+	if err != nil {
+		return resolved, err
+	}
+	if *debug {
+		resolved.LogLevel = logrus.DebugLevel
+	}
+	if resolved.LogFormat != logText && resolved.LogFormat != logJSON {
+		return resolved, fmt.Errorf("%q is not a supported log format, use text or json", resolved.LogFormat)
+	}
+	return resolved, nil
+}
+
+// applySettings puts the settings into effect
+func applySettings(resolved settings) {
+	currentLock.Lock()
+	current = resolved
+	currentLock.Unlock()
+
+	logrus.SetLevel(resolved.LogLevel)
+	if resolved.LogFormat == logJSON {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	}
+}
+
+// reloadConfig reads --config again and applies the settings that can change
+// while the service runs. A config that fails to load or check leaves the
+// current settings as they are.
+func reloadConfig() {
+	config, err := loadConfig()
+	if err == nil {
+		var resolved settings
+		resolved, err = resolveSettings(config)
+		if err == nil {
+			applySettings(resolved)
+		}
+	}
+	if err != nil {
+		logrus.WithError(err).Errorf("Could not reload %s, keeping the current settings", *configFile)
+		return
+	}
+
+	if !reflect.DeepEqual(config.Shards, loadedConfig.Shards) {
+		logrus.Warningf("The shards in %s changed, which only takes effect on restart; use the shard admin API to change them now", *configFile)
+	}
+	loadedConfig = config
+	logrus.Infof("Reloaded %s", *configFile)
+}
+
+// watchConfig reloads --config on SIGHUP, and whenever it is modified as
+// checked every --config_poll
+func watchConfig() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	modified := configModified(time.Time{})
+	poll := time.NewTicker(*configPoll)
+	defer poll.Stop()
+	for {
+		select {
+		case <-hangups:
+			logrus.Infof("Got SIGHUP, reloading %s", *configFile)
+			modified = configModified(modified)
+			reloadConfig()
+		case <-poll.C:
+			latest := configModified(modified)
+			if latest.Equal(modified) {
+				continue
+			}
+			modified = latest
+			reloadConfig()
+		}
+	}
+}
+
+// configModified returns when --config was last modified, or previous if it
+// can't be read
+func configModified(previous time.Time) time.Time {
+	info, err := os.Stat(*configFile)
+	if err != nil {
+		return previous
+	}
+	return info.ModTime()
+}
+
+// requireAdminTokens returns a middleware that turns away every request while
+// no admin tokens are configured, for the admin endpoints that shouldn't be
+// left open
+func requireAdminTokens() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(currentSettings().AdminTokens) == 0 {
+			c.JSON(http.StatusForbidden, map[string]string{
+				"message": "This endpoint is disabled until an admin token is configured",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireToken returns a middleware that turns away requests without a
+// bearer token, once any tokens are configured. Admin tokens work everywhere,
+// the others only outside the admin API.
+func requireToken(admin bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		current := currentSettings()
+		if len(current.APITokens) == 0 && len(current.AdminTokens) == 0 {
+			c.Next()
+			return
+		}
+
+		given := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+		accepted := current.AdminTokens
+		if !admin {
+			accepted = append(append([]string(nil), accepted...), current.APITokens...)
+		}
+		for _, token := range accepted {
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+				c.Next()
+				return
+			}
+		}
+
+		status := http.StatusUnauthorized
+		if given != "" {
+			status = http.StatusForbidden
+		}
+		c.JSON(status, map[string]string{
+			"message": "A valid token is required",
+		})
+		c.Abort()
+	}
+}
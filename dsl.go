@@ -0,0 +1,402 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// dslFilter is a node of the filter tree of a structured query. A node is
+// either a comparison of a field against a value, or combines other nodes
+// with and, or or not.
+type dslFilter struct {
+	And []dslFilter `json:"and"`
+	Or  []dslFilter `json:"or"`
+	Not *dslFilter  `json:"not"`
+
+	Field string `json:"field"`
+	// Op is one of eq, ne, lt, lte, gt, gte, in or like
+	Op string `json:"op"`
+	// Value is what the field is compared against, or a list of values for in
+	Value interface{} `json:"value"`
+}
+
+// dslTimeRange limits a structured query to the events whose time falls
+// between From (inclusive) and To (exclusive), both RFC3339
+type dslTimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// dslAggregate is a single aggregate column of a structured query
+type dslAggregate struct {
+	// Op is one of count, sum, avg, min or max
+	Op string `json:"op"`
+	// Field may be * for count
+	Field string `json:"field"`
+	// As names the result column, defaulting to the op and field joined by an
+	// underscore
+	As string `json:"as"`
+}
+
+// dslOrder is a single term of the ordering of a structured query
+type dslOrder struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc"`
+}
+
+// dslComparisons maps the comparison ops of a filter to their SQL operator
+var dslComparisons = map[string]string{
+	"eq":  "=",
+	"ne":  "<>",
+	"lt":  "<",
+	"lte": "<=",
+	"gt":  ">",
+	"gte": ">=",
+}
+
+// dslNumericTypes are the schema types that can be summed and averaged
+var dslNumericTypes = map[string]bool{
+	"int":    true,
+	"bigint": true,
+	"float":  true,
+}
+
+// dslCompiler turns a structured query into SQL, collecting everything wrong
+// with the document on the way keyed by where in the document it is
+type dslCompiler struct {
+	// columns maps the lower-cased name of every column of the family to its
+	// schema type
+	columns     map[string]string
+	args        []interface{}
+	fieldErrors map[string]string
+}
+
+// compileStructuredQuery validates a structured query against the columns of
+// its family and compiles it to a SELECT with a placeholder for every value.
+// columns maps the lower-cased name of every column the family has to its
+// schema type. If the document is invalid the returned map holds an error
+// message for every problem, keyed by its path in the document.
+func compileStructuredQuery(body StructuredQueryBody, columns map[string]string) (string, []interface{}, map[string]string) {
+	compiler := &dslCompiler{
+		columns:     columns,
+		fieldErrors: map[string]string{},
+	}
+
+	var selected, grouped []string
+	outputs := map[string]bool{}
+	aggregating := len(body.GroupBy) > 0 || len(body.Aggregates) > 0
+	if aggregating {
+		if len(body.Fields) > 0 {
+			compiler.fieldErrors["fields"] = "fields can't be combined with group_by or aggregates; group_by fields are selected automatically"
+		}
+		for i, field := range body.GroupBy {
+			path := fmt.Sprintf("group_by[%d]", i)
+			if _, ok := compiler.fieldType(path, field); ok {
+				selected = append(selected, quoteIdentifier(field))
+				grouped = append(grouped, quoteIdentifier(field))
+				outputs[strings.ToLower(field)] = true
+			}
+		}
+		for i, aggregate := range body.Aggregates {
+			path := fmt.Sprintf("aggregates[%d]", i)
+			expression, name, ok := compiler.aggregate(path, aggregate)
+			if !ok {
+				continue
+			}
+			if outputs[strings.ToLower(name)] {
+				compiler.fieldErrors[path+".as"] = fmt.Sprintf("%s is already the name of another result column", name)
+				continue
+			}
+			outputs[strings.ToLower(name)] = true
+			selected = append(selected, expression+" AS "+quoteIdentifier(name))
+		}
+	} else {
+		for i, field := range body.Fields {
+			path := fmt.Sprintf("fields[%d]", i)
+			if _, ok := compiler.fieldType(path, field); ok {
+				selected = append(selected, quoteIdentifier(field))
+			}
+		}
+		if len(selected) == 0 {
+			selected = []string{"*"}
+		}
+	}
+
+	var conditions []string
+	if body.TimeRange != nil {
+		conditions = append(conditions, compiler.timeRange(*body.TimeRange)...)
+	}
+	if body.Filter != nil {
+		if condition := compiler.filter("filter", *body.Filter); condition != "" {
+			conditions = append(conditions, condition)
+		}
+	}
+
+	var order []string
+	for i, term := range body.Order {
+		path := fmt.Sprintf("order[%d]", i)
+		if aggregating {
+			// Only the result columns exist once the rows have been grouped
+			if !outputs[strings.ToLower(term.Field)] {
+				compiler.fieldErrors[path] = fmt.Sprintf("%s is not a group_by field or aggregate", term.Field)
+				continue
+			}
+		} else if _, ok := compiler.fieldType(path, term.Field); !ok {
+			continue
+		}
+		direction := "ASC"
+		if term.Desc {
+			direction = "DESC"
+		}
+		order = append(order, quoteIdentifier(term.Field)+" "+direction)
+	}
+
+	if body.Limit < 0 {
+		compiler.fieldErrors["limit"] = "limit can't be negative"
+	}
+
+	if len(compiler.fieldErrors) > 0 {
+		return "", nil, compiler.fieldErrors
+	}
+
+	query := "SELECT " + strings.Join(selected, ", ") + " FROM " + quoteIdentifier(body.Family)
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	if len(grouped) > 0 {
+		query += " GROUP BY " + strings.Join(grouped, ", ")
+	}
+	if len(order) > 0 {
+		query += " ORDER BY " + strings.Join(order, ", ")
+	}
+	// The limit is a validated integer and is written into the query so
+	// planQuery can apply it when merging the rows of several shards
+	if body.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", body.Limit)
+	}
+
+	return query, compiler.args, nil
+}
+
+// fieldType returns the schema type of a field of the family, recording an
+// error at path if there is no such field
+func (compiler *dslCompiler) fieldType(path string, field string) (string, bool) {
+	if !validIdentifier(field) {
+		compiler.fieldErrors[path] = fmt.Sprintf("%q is not a valid field name", field)
+		return "", false
+	}
+	columnType, ok := compiler.columns[strings.ToLower(field)]
+	if !ok {
+		compiler.fieldErrors[path] = fmt.Sprintf("The family has no %s field", field)
+		return "", false
+	}
+	return columnType, true
+}
+
+// aggregate compiles an aggregate to its SQL expression and the name of its
+// result column
+func (compiler *dslCompiler) aggregate(path string, aggregate dslAggregate) (string, string, bool) {
+	op := strings.ToLower(aggregate.Op)
+	name := aggregate.As
+	if name == "" {
+		name = op
+		if aggregate.Field != "*" {
+			name += "_" + aggregate.Field
+		}
+	}
+	if !validIdentifier(name) {
+		compiler.fieldErrors[path+".as"] = fmt.Sprintf("%q is not a valid result column name", name)
+		return "", "", false
+	}
+
+	switch op {
+	case "count", "sum", "avg", "min", "max":
+	default:
+		compiler.fieldErrors[path+".op"] = fmt.Sprintf("Unsupported aggregate %q", aggregate.Op)
+		return "", "", false
+	}
+
+	if aggregate.Field == "*" {
+		if op != "count" {
+			compiler.fieldErrors[path+".field"] = fmt.Sprintf("%s needs a field", op)
+			return "", "", false
+		}
+		return "COUNT(*)", name, true
+	}
+
+	columnType, ok := compiler.fieldType(path+".field", aggregate.Field)
+	if !ok {
+		return "", "", false
+	}
+	switch {
+	case (op == "sum" || op == "avg") && !dslNumericTypes[columnType]:
+		compiler.fieldErrors[path+".field"] = fmt.Sprintf("%s needs a numeric field but %s is a %s", op, aggregate.Field, columnType)
+		return "", "", false
+	case (op == "min" || op == "max") && columnType == "json":
+		compiler.fieldErrors[path+".field"] = fmt.Sprintf("%s can't be applied to the json field %s", op, aggregate.Field)
+		return "", "", false
+	}
+
+	return strings.ToUpper(op) + "(" + quoteIdentifier(aggregate.Field) + ")", name, true
+}
+
+// timeRange compiles the time range of a query to conditions on the time
+// column every family table has
+func (compiler *dslCompiler) timeRange(timeRange dslTimeRange) []string {
+	var conditions []string
+	var from, to time.Time
+	var err error
+
+	if timeRange.From != "" {
+		from, err = time.Parse(time.RFC3339Nano, timeRange.From)
+		if err != nil {
+			compiler.fieldErrors["time_range.from"] = fmt.Sprintf("expected an RFC3339 time but got %q", timeRange.From)
+		} else {
+			conditions = append(conditions, "`time` >= ?")
+			compiler.args = append(compiler.args, from.UTC())
+		}
+	}
+	if timeRange.To != "" {
+		to, err = time.Parse(time.RFC3339Nano, timeRange.To)
+		if err != nil {
+			compiler.fieldErrors["time_range.to"] = fmt.Sprintf("expected an RFC3339 time but got %q", timeRange.To)
+		} else {
+			conditions = append(conditions, "`time` < ?")
+			compiler.args = append(compiler.args, to.UTC())
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		compiler.fieldErrors["time_range"] = "from must be before to"
+	}
+
+	return conditions
+}
+
+// bounds returns the times of a time range that parse, leaving the rest for
+// the compiler to report
+func (timeRange dslTimeRange) bounds() (from *time.Time, to *time.Time) {
+	if t, err := time.Parse(time.RFC3339Nano, timeRange.From); err == nil {
+		from = &t
+	}
+	if t, err := time.Parse(time.RFC3339Nano, timeRange.To); err == nil {
+		to = &t
+	}
+	return from, to
+}
+
+// filter compiles a node of the filter tree to a parenthesized condition,
+// appending the values it compares against to the query arguments
+func (compiler *dslCompiler) filter(path string, node dslFilter) string {
+	forms := 0
+	if node.And != nil {
+		forms++
+	}
+	if node.Or != nil {
+		forms++
+	}
+	if node.Not != nil {
+		forms++
+	}
+	if node.Field != "" || node.Op != "" {
+		forms++
+	}
+	if forms != 1 {
+		compiler.fieldErrors[path] = "A filter must have exactly one of and, or, not, or a field and op"
+		return ""
+	}
+
+	switch {
+	case node.And != nil, node.Or != nil:
+		nodes, joiner, key := node.And, " AND ", "and"
+		if node.Or != nil {
+			nodes, joiner, key = node.Or, " OR ", "or"
+		}
+		if len(nodes) == 0 {
+			compiler.fieldErrors[path+"."+key] = fmt.Sprintf("%s needs at least one filter", key)
+			return ""
+		}
+		conditions := make([]string, 0, len(nodes))
+		for i, child := range nodes {
+			conditions = append(conditions, compiler.filter(fmt.Sprintf("%s.%s[%d]", path, key, i), child))
+		}
+		return "(" + strings.Join(conditions, joiner) + ")"
+	case node.Not != nil:
+		return "(NOT " + compiler.filter(path+".not", *node.Not) + ")"
+	}
+
+	columnType, ok := compiler.fieldType(path+".field", node.Field)
+	if !ok {
+		return ""
+	}
+	if columnType == "json" {
+		compiler.fieldErrors[path+".field"] = fmt.Sprintf("The json field %s can't be filtered on", node.Field)
+		return ""
+	}
+	column := quoteIdentifier(node.Field)
+
+	op := strings.ToLower(node.Op)
+	switch op {
+	case "in":
+		values, ok := node.Value.([]interface{})
+		if !ok || len(values) == 0 {
+			compiler.fieldErrors[path+".value"] = "in needs a non-empty list of values"
+			return ""
+		}
+		placeholders := make([]string, len(values))
+		for i, value := range values {
+			if !compiler.bind(fmt.Sprintf("%s.value[%d]", path, i), columnType, value) {
+				return ""
+			}
+			placeholders[i] = "?"
+		}
+		return "(" + column + " IN (" + strings.Join(placeholders, ", ") + "))"
+	case "like":
+		if columnType != "string" && columnType != "text" {
+			compiler.fieldErrors[path+".op"] = fmt.Sprintf("like needs a string field but %s is a %s", node.Field, columnType)
+			return ""
+		}
+		if _, ok := node.Value.(string); !ok {
+			compiler.fieldErrors[path+".value"] = "like needs a string pattern"
+			return ""
+		}
+		compiler.args = append(compiler.args, node.Value)
+		return "(" + column + " LIKE ?)"
+	}
+
+	operator, ok := dslComparisons[op]
+	if !ok {
+		compiler.fieldErrors[path+".op"] = fmt.Sprintf("Unsupported filter op %q", node.Op)
+		return ""
+	}
+	if node.Value == nil {
+		switch op {
+		case "eq":
+			return "(" + column + " IS NULL)"
+		case "ne":
+			return "(" + column + " IS NOT NULL)"
+		}
+		compiler.fieldErrors[path+".value"] = fmt.Sprintf("%s can't compare against null", op)
+		return ""
+	}
+	if !compiler.bind(path+".value", columnType, node.Value) {
+		return ""
+	}
+	return "(" + column + " " + operator + " ?)"
+}
+
+// bind encodes a value the way it is stored in a column of the given schema
+// type and appends it to the query arguments
+func (compiler *dslCompiler) bind(path string, columnType string, value interface{}) bool {
+	if value == nil {
+		compiler.fieldErrors[path] = "null can only be compared with eq or ne"
+		return false
+	}
+	encoded, err := encodeValue(columnType, value)
+	if err != nil {
+		compiler.fieldErrors[path] = err.Error()
+		return false
+	}
+	compiler.args = append(compiler.args, encoded)
+	return true
+}
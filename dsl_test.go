@@ -0,0 +1,172 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// dslTestColumns are the columns of the family the structured queries below
+// are compiled against
+var dslTestColumns = map[string]string{
+	"name":   "string",
+	"breed":  "string",
+	"age":    "int",
+	"weight": "float",
+	"tags":   "json",
+}
+
+func TestCompileStructuredQuery(t *testing.T) {
+	from := time.Date(2017, 1, 12, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2017, 1, 13, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		body  StructuredQueryBody
+		query string
+		args  []interface{}
+	}{
+		{
+			name:  "every field",
+			body:  StructuredQueryBody{Family: "dog"},
+			query: "SELECT * FROM `dog`",
+		},
+		{
+			name:  "fields",
+			body:  StructuredQueryBody{Family: "dog", Fields: []string{"name", "AGE"}},
+			query: "SELECT `name`, `AGE` FROM `dog`",
+		},
+		{
+			name:  "quoted family",
+			body:  StructuredQueryBody{Family: "dog`s"},
+			query: "SELECT * FROM `dog``s`",
+		},
+		{
+			name: "values are bound, not inlined",
+			body: StructuredQueryBody{Family: "dog", Filter: &dslFilter{
+				Field: "name", Op: "eq", Value: "x' OR '1'='1",
+			}},
+			query: "SELECT * FROM `dog` WHERE (`name` = ?)",
+			args:  []interface{}{"x' OR '1'='1"},
+		},
+		{
+			name: "like patterns are bound",
+			body: StructuredQueryBody{Family: "dog", Filter: &dslFilter{
+				Field: "breed", Op: "like", Value: "%`; DROP TABLE dog; --",
+			}},
+			query: "SELECT * FROM `dog` WHERE (`breed` LIKE ?)",
+			args:  []interface{}{"%`; DROP TABLE dog; --"},
+		},
+		{
+			name: "in",
+			body: StructuredQueryBody{Family: "dog", Filter: &dslFilter{
+				Field: "age", Op: "in", Value: []interface{}{float64(1), float64(2)},
+			}},
+			query: "SELECT * FROM `dog` WHERE (`age` IN (?, ?))",
+			args:  []interface{}{int64(1), int64(2)},
+		},
+		{
+			name:  "null",
+			body:  StructuredQueryBody{Family: "dog", Filter: &dslFilter{Not: &dslFilter{Field: "name", Op: "ne"}}},
+			query: "SELECT * FROM `dog` WHERE (NOT (`name` IS NOT NULL))",
+		},
+		{
+			name: "nested filters",
+			body: StructuredQueryBody{Family: "dog", Filter: &dslFilter{And: []dslFilter{
+				{Field: "age", Op: "gte", Value: float64(3)},
+				{Or: []dslFilter{
+					{Field: "breed", Op: "eq", Value: "collie"},
+					{Field: "weight", Op: "lt", Value: 10.5},
+				}},
+			}}},
+			query: "SELECT * FROM `dog` WHERE ((`age` >= ?) AND ((`breed` = ?) OR (`weight` < ?)))",
+			args:  []interface{}{int64(3), "collie", 10.5},
+		},
+		{
+			name: "time range",
+			body: StructuredQueryBody{Family: "dog", TimeRange: &dslTimeRange{
+				From: "2017-01-12T01:00:00+01:00", To: "2017-01-13T00:00:00Z",
+			}, Filter: &dslFilter{Field: "name", Op: "eq", Value: "rex"}},
+			query: "SELECT * FROM `dog` WHERE `time` >= ? AND `time` < ? AND (`name` = ?)",
+			args:  []interface{}{from, to, "rex"},
+		},
+		{
+			name: "aggregates",
+			body: StructuredQueryBody{
+				Family:  "dog",
+				GroupBy: []string{"breed"},
+				Aggregates: []dslAggregate{
+					{Op: "count", Field: "*"},
+					{Op: "AVG", Field: "age", As: "mean_age"},
+				},
+				Order: []dslOrder{{Field: "count", Desc: true}, {Field: "breed"}},
+				Limit: 10,
+			},
+			query: "SELECT `breed`, COUNT(*) AS `count`, AVG(`age`) AS `mean_age` FROM `dog` GROUP BY `breed` ORDER BY `count` DESC, `breed` ASC LIMIT 10",
+		},
+	}
+
+	for _, test := range tests {
+		query, args, fieldErrors := compileStructuredQuery(test.body, dslTestColumns)
+		if len(fieldErrors) > 0 {
+			t.Errorf("%s: unexpected errors %v", test.name, fieldErrors)
+			continue
+		}
+		if query != test.query {
+			t.Errorf("%s: got %s, expected %s", test.name, query, test.query)
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s: got args %#v, expected %#v", test.name, args, test.args)
+		}
+	}
+}
+
+func TestCompileStructuredQueryErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body StructuredQueryBody
+		// path is where in the document the error is expected
+		path string
+	}{
+		{"invalid field name", StructuredQueryBody{Fields: []string{"na`me"}}, "fields[0]"},
+		{"injected field name", StructuredQueryBody{Fields: []string{"name FROM raw_logs --"}}, "fields[0]"},
+		{"unknown field", StructuredQueryBody{Fields: []string{"owner"}}, "fields[0]"},
+		{"fields with aggregates", StructuredQueryBody{Fields: []string{"name"}, GroupBy: []string{"breed"}}, "fields"},
+		{"two forms", StructuredQueryBody{Filter: &dslFilter{Field: "name", Op: "eq", Value: "rex", Not: &dslFilter{}}}, "filter"},
+		{"empty and", StructuredQueryBody{Filter: &dslFilter{And: []dslFilter{}}}, "filter.and"},
+		{"nested path", StructuredQueryBody{Filter: &dslFilter{Or: []dslFilter{
+			{Field: "name", Op: "eq", Value: "rex"},
+			{Field: "owner", Op: "eq", Value: "bob"},
+		}}}, "filter.or[1].field"},
+		{"unsupported op", StructuredQueryBody{Filter: &dslFilter{Field: "name", Op: "regexp", Value: ".*"}}, "filter.op"},
+		{"json field", StructuredQueryBody{Filter: &dslFilter{Field: "tags", Op: "eq", Value: "x"}}, "filter.field"},
+		{"like on a number", StructuredQueryBody{Filter: &dslFilter{Field: "age", Op: "like", Value: "1%"}}, "filter.op"},
+		{"like without a string", StructuredQueryBody{Filter: &dslFilter{Field: "name", Op: "like", Value: float64(1)}}, "filter.value"},
+		{"empty in", StructuredQueryBody{Filter: &dslFilter{Field: "age", Op: "in", Value: []interface{}{}}}, "filter.value"},
+		{"wrong type in in", StructuredQueryBody{Filter: &dslFilter{Field: "age", Op: "in", Value: []interface{}{"1", true}}}, "filter.value[1]"},
+		{"null ordering", StructuredQueryBody{Filter: &dslFilter{Field: "age", Op: "lt"}}, "filter.value"},
+		{"wrong type", StructuredQueryBody{Filter: &dslFilter{Field: "age", Op: "eq", Value: "1 OR 1=1"}}, "filter.value"},
+		{"unsupported aggregate", StructuredQueryBody{Aggregates: []dslAggregate{{Op: "median", Field: "age"}}}, "aggregates[0].op"},
+		{"sum of everything", StructuredQueryBody{Aggregates: []dslAggregate{{Op: "sum", Field: "*"}}}, "aggregates[0].field"},
+		{"average of a string", StructuredQueryBody{Aggregates: []dslAggregate{{Op: "avg", Field: "name"}}}, "aggregates[0].field"},
+		{"maximum of json", StructuredQueryBody{Aggregates: []dslAggregate{{Op: "max", Field: "tags"}}}, "aggregates[0].field"},
+		{"injected result name", StructuredQueryBody{Aggregates: []dslAggregate{{Op: "count", Field: "*", As: "n` FROM raw_logs"}}}, "aggregates[0].as"},
+		{"duplicate result name", StructuredQueryBody{GroupBy: []string{"breed"}, Aggregates: []dslAggregate{{Op: "count", Field: "*", As: "breed"}}}, "aggregates[0].as"},
+		{"ordering by a grouped away field", StructuredQueryBody{GroupBy: []string{"breed"}, Order: []dslOrder{{Field: "age"}}}, "order[0]"},
+		{"ordering by an unknown field", StructuredQueryBody{Order: []dslOrder{{Field: "owner"}}}, "order[0]"},
+		{"negative limit", StructuredQueryBody{Limit: -1}, "limit"},
+		{"bad time", StructuredQueryBody{TimeRange: &dslTimeRange{From: "yesterday"}}, "time_range.from"},
+		{"backwards time range", StructuredQueryBody{TimeRange: &dslTimeRange{From: "2017-01-13T00:00:00Z", To: "2017-01-12T00:00:00Z"}}, "time_range"},
+	}
+
+	for _, test := range tests {
+		test.body.Family = "dog"
+		query, args, fieldErrors := compileStructuredQuery(test.body, dslTestColumns)
+		if _, ok := fieldErrors[test.path]; !ok {
+			t.Errorf("%s: expected an error at %s, got %v", test.name, test.path, fieldErrors)
+		}
+		if query != "" || args != nil {
+			t.Errorf("%s: got a query %q for an invalid document", test.name, query)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// The states the health checker can find a shard in
+const (
+	shardUp = "up"
+	// shardDegraded is a shard that has started failing health checks, or
+	// one that is passing them again after being down but hasn't yet passed
+	// enough of them in a row to be trusted
+	shardDegraded = "degraded"
+	// shardDown is a shard that failed --health_fall checks in a row, or one
+	// that hasn't been connected to yet. It gets no new families and no
+	// queries.
+	shardDown = "down"
+)
+
+// shardHealth tracks the health checks of a shard. It is shared by every copy
+// of the Shard it belongs to.
+type shardHealth struct {
+	sync.Mutex
+	State     string
+	Since     time.Time
+	LastCheck time.Time
+	Latency   time.Duration
+	LastError string
+	// failures and successes count the checks failed or passed in a row
+	failures  int
+	successes int
+	// pinging is set while a ping that overran --health_timeout is still
+	// waiting for the shard, so pings don't pile up on a shard that hangs
+	pinging bool
+}
+
+// shardHealthStatus is how the health of a shard is shown by the admin API
+type shardHealthStatus struct {
+	ShardID   string     `json:"shard_id"`
+	State     string     `json:"state"`
+	Connected bool       `json:"connected"`
+	Since     time.Time  `json:"since"`
+	LastCheck *time.Time `json:"last_check,omitempty"`
+	LatencyMs float64    `json:"latency_ms"`
+	Failures  int        `json:"consecutive_failures"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// pendingShard is a configured shard that couldn't be connected to yet
+type pendingShard struct {
+	ID     string
+	Config ShardConfig
+	Health *shardHealth
+}
+
+// unreachable holds the configured shards the health checker keeps trying to
+// connect to, guarded by databasesLock like databases
+var unreachable []pendingShard
+
+// newShardHealth starts tracking the health of a shard in the given state
+func newShardHealth(state string) *shardHealth {
+	return &shardHealth{State: state, Since: time.Now()}
+}
+
+// state returns the current state of the shard
+func (health *shardHealth) state() string {
+	health.Lock()
+	defer health.Unlock()
+	return health.State
+}
+
+// observe records the outcome of a health check and moves the shard between
+// states. A shard is only marked down after --health_fall failures in a row
+// and only back up after --health_rise successes in a row, so a single slow
+// or lost ping doesn't flap it.
+func (health *shardHealth) observe(id string, err error, latency time.Duration) {
+	health.Lock()
+	defer health.Unlock()
+
+	now := time.Now()
+	health.LastCheck = now
+	health.Latency = latency
+	state := health.State
+	if err != nil {
+		health.LastError = err.Error()
+		health.failures++
+		health.successes = 0
+		if health.failures >= *healthFall {
+			state = shardDown
+		} else if state == shardUp {
+			state = shardDegraded
+		}
+	} else {
+		health.LastError = ""
+		health.successes++
+		health.failures = 0
+		if health.successes >= *healthRise {
+			state = shardUp
+		} else if state == shardDown {
+			state = shardDegraded
+		}
+	}
+
+	if state == health.State {
+		return
+	}
+	entry := logrus.WithField("shard", id)
+	switch state {
+	case shardUp:
+		entry.Infof("%s is up again", id)
+	case shardDegraded:
+		entry.Warningf("%s is degraded after being %s", id, health.State)
+	case shardDown:
+		entry.WithError(err).Errorf("%s is down", id)
+	}
+	health.State = state
+	health.Since = now
+}
+
+// status returns the health of a shard as shown by the admin API
+func (health *shardHealth) status(id string, connected bool) shardHealthStatus {
+	health.Lock()
+	defer health.Unlock()
+	status := shardHealthStatus{
+		ShardID:   id,
+		State:     health.State,
+		Connected: connected,
+		Since:     health.Since,
+		LatencyMs: float64(health.Latency) / float64(time.Millisecond),
+		Failures:  health.failures,
+		Error:     health.LastError,
+	}
+	if !health.LastCheck.IsZero() {
+		lastCheck := health.LastCheck
+		status.LastCheck = &lastCheck
+	}
+	return status
+}
+
+// down reports whether the health checker has given up on the shard
+func (shard Shard) down() bool {
+	return shard.Health.state() == shardDown
+}
+
+// connectedShards returns every shard that has been connected to, whatever
+// its health
+func connectedShards() []Shard {
+	databasesLock.RLock()
+	defer databasesLock.RUnlock()
+	return databases
+}
+
+// liveShards returns the connected shards that aren't down
+func liveShards() []Shard {
+	var live []Shard
+	for _, shard := range connectedShards() {
+		if !shard.down() {
+			live = append(live, shard)
+		}
+	}
+	return live
+}
+
+// attachShard starts using a shard that was connected to after startup, and
+// stops again if its catalog can't be loaded
+func attachShard(shard Shard) error {
+	err := prepareSchema(shard)
+	if err != nil {
+		return err
+	}
+
+	databasesLock.Lock()
+	// The slice is replaced rather than appended to in place, since callers
+	// of connectedShards may still be reading the old one
+	databases = append(databases[:len(databases):len(databases)], shard)
+	databasesLock.Unlock()
+
+	err = loadShardCatalog(shard)
+	if err != nil {
+		detachShard(shard.ID)
+		return err
+	}
+	return nil
+}
+
+// detachShard stops using the connected shard with the given ID
+func detachShard(id string) {
+	databasesLock.Lock()
+	defer databasesLock.Unlock()
+	var remaining []Shard
+	for _, shard := range databases {
+		if shard.ID != id {
+			remaining = append(remaining, shard)
+		}
+	}
+	databases = remaining
+}
+
+// checkHealth pings every connected shard and tries connecting to those that
+// haven't been yet
+func checkHealth() {
+	var checks sync.WaitGroup
+	for _, shard := range connectedShards() {
+		checks.Add(1)
+		go func(shard Shard) {
+			defer checks.Done()
+			started := time.Now()
+			err := pingShard(shard)
+			shard.Health.observe(shard.ID, err, time.Since(started))
+		}(shard)
+	}
+	checks.Wait()
+
+	databasesLock.RLock()
+	pending := unreachable
+	databasesLock.RUnlock()
+	for _, waiting := range pending {
+		connectPending(waiting)
+	}
+}
+
+// pingShard runs a query on a shard, since the MySQL driver doesn't implement
+// pings and database/sql would otherwise only hand back an idle connection. The
+// driver ignores contexts too, so --health_timeout is enforced here and a ping
+// that overruns is left to finish in the background.
+func pingShard(shard Shard) error {
+	health := shard.Health
+	health.Lock()
+	if health.pinging {
+		health.Unlock()
+		return fmt.Errorf("the previous health check has not finished")
+	}
+	health.pinging = true
+	health.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := shard.DB.DB().Conn(context.Background())
+		if err == nil {
+			var one int
+			err = conn.QueryRowContext(context.Background(), "SELECT 1").Scan(&one)
+			conn.Close()
+		}
+		health.Lock()
+		health.pinging = false
+		health.Unlock()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(*healthTimeout):
+		return fmt.Errorf("no answer within %s", *healthTimeout)
+	}
+}
+
+// connectPending tries connecting to a shard that couldn't be connected to
+// yet, and starts using it if that works
+func connectPending(waiting pendingShard) {
+	shard, err := connectShard(waiting.Config)
+	if err != nil {
+		waiting.Health.observe(waiting.ID, err, 0)
+		return
+	}
+
+	// The shard may have been decommissioned while connecting to it
+	shardAdminLock.Lock()
+	defer shardAdminLock.Unlock()
+	databasesLock.Lock()
+	var stillPending []pendingShard
+	found := false
+	for _, other := range unreachable {
+		if other.ID == waiting.ID {
+			found = true
+		} else {
+			stillPending = append(stillPending, other)
+		}
+	}
+	databasesLock.Unlock()
+	if !found {
+		closeShard(shard)
+		return
+	}
+
+	shard.Health = waiting.Health
+	err = attachShard(shard)
+	if err != nil {
+		logrus.WithError(err).Errorf("Connected to %s but could not start using it", shard.ID)
+		waiting.Health.observe(waiting.ID, err, 0)
+		closeShard(shard)
+		return
+	}
+	shard.Health.observe(shard.ID, nil, 0)
+
+	databasesLock.Lock()
+	unreachable = stillPending
+	databasesLock.Unlock()
+	logrus.Infof("Connected to %s, which was unreachable until now", shard.ID)
+}
+
+// healthLoop runs the health checker every --health_interval
+func healthLoop() {
+	for {
+		time.Sleep(*healthInterval)
+		checkHealth()
+	}
+}
+
+// ShowHealth is the admin handler showing the health of every configured
+// shard
+func ShowHealth(c *gin.Context) {
+	shards := []shardHealthStatus{}
+	for _, shard := range connectedShards() {
+		shards = append(shards, shard.Health.status(shard.ID, true))
+	}
+	databasesLock.RLock()
+	for _, waiting := range unreachable {
+		shards = append(shards, waiting.Health.status(waiting.ID, false))
+	}
+	databasesLock.RUnlock()
+	sort.Slice(shards, func(i, j int) bool {
+		return shards[i].ShardID < shards[j].ShardID
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"shards": shards,
+	})
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// hintBatch is the most hints a shard replays in a single pass
+const hintBatch = 100
+
+// hintTimeLayout is how times are kept in a hint, which MySQL reads back into
+// the same value the driver would have sent
+const hintTimeLayout = "2006-01-02 15:04:05.999999"
+
+// ReplicaHint holds events a replica of a family table missed, on one of the
+// replicas that stored them, until they are replayed to it. Columns, Rows and
+// RawLogs are JSON encoded, and Schema is the schema of the request, which the
+// replica may not have caught up with either.
+type ReplicaHint struct {
+	ID        uint
+	Family    string `gorm:"size:64"`
+	ShardID   string `gorm:"size:255;index"`
+	Schema    string `gorm:"type:text"`
+	Columns   string `gorm:"type:text"`
+	Rows      string `gorm:"type:mediumtext"`
+	RawLogs   string `gorm:"type:mediumtext"`
+	CreatedAt time.Time
+}
+
+// hintKey is a replica of a family table with hints waiting for it
+type hintKey struct {
+	Family  string
+	ShardID string
+}
+
+// pendingHints holds, for every shard holding hints, the replicas they are
+// for. A replica with hints waiting is behind the others, so it isn't read
+// from while another one will do.
+var (
+	pendingHints     = map[string]map[hintKey]bool{}
+	pendingHintsLock sync.RWMutex
+)
+
+// missedReplicas returns the IDs of the shards holding a family table that
+// didn't store the events of a request, including those that were down
+func missedReplicas(table string, stored map[string]bool) []string {
+	var missed []string
+	for _, placement := range readablePlacements(placementsOf(table)) {
+		if !stored[placement.ShardID] {
+			missed = append(missed, placement.ShardID)
+		}
+	}
+	return missed
+}
+
+// leaveHints records the events of a request for every replica that missed
+// them, on the first replica that stored them and takes the hint. A replica
+// no hint could be left for stays behind, which is logged.
+func leaveHints(body IngestLogBody, stored map[string]bool, missed []string, columns []string, familyRows [][]interface{}, rawRows [][]interface{}) {
+	hint, err := encodeHint(body, columns, familyRows, rawRows)
+	if err != nil {
+		logrus.WithError(err).Errorf("Could not encode a hint for the replicas of the %s log family", body.Family)
+		return
+	}
+	holders := make([]string, 0, len(stored))
+	for id := range stored {
+		holders = append(holders, id)
+	}
+	sort.Strings(holders)
+
+	for _, shardID := range missed {
+		left := false
+		for _, holderID := range holders {
+			holder, ok := shardByID(holderID)
+			if !ok {
+				continue
+			}
+			shardHint := hint
+			shardHint.ShardID = shardID
+			err = holder.DB.Create(&shardHint).Error
+			if err != nil {
+				logrus.WithError(err).Warningf("Could not leave a hint for %s on %s", shardID, holderID)
+				continue
+			}
+			markHint(holderID, hintKey{Family: body.Family, ShardID: shardID})
+			left = true
+			break
+		}
+		if !left {
+			logrus.Errorf("%s missed events of the %s log family and no hint could be left for it", shardID, body.Family)
+		}
+	}
+}
+
+// encodeHint turns the rows of a request into a hint. Times are written out
+// in full, since JSON would otherwise only keep them as RFC3339 strings.
+func encodeHint(body IngestLogBody, columns []string, familyRows [][]interface{}, rawRows [][]interface{}) (ReplicaHint, error) {
+	rows := make([][]interface{}, len(familyRows))
+	for i, row := range familyRows {
+		rows[i] = make([]interface{}, len(row))
+		for j, value := range row {
+			if t, ok := value.(time.Time); ok {
+				value = t.UTC().Format(hintTimeLayout)
+			}
+			rows[i][j] = value
+		}
+	}
+	logs := make([]interface{}, len(rawRows))
+	for i, raw := range rawRows {
+		logs[i] = raw[1]
+	}
+
+	hint := ReplicaHint{Family: body.Family}
+	for _, part := range []struct {
+		value   interface{}
+		encoded *string
+	}{
+		{body.Schema, &hint.Schema},
+		{columns, &hint.Columns},
+		{rows, &hint.Rows},
+		{logs, &hint.RawLogs},
+	} {
+		encoded, err := json.Marshal(part.value)
+		if err != nil {
+			return hint, err
+		}
+		*part.encoded = string(encoded)
+	}
+	return hint, nil
+}
+
+// decodeHint turns a hint back into the request it was left for. Numbers are
+// kept as they were written, so that large integers survive.
+func decodeHint(hint ReplicaHint) (IngestLogBody, []string, [][]interface{}, [][]interface{}, error) {
+	body := IngestLogBody{Family: hint.Family}
+	var columns []string
+	var rows [][]interface{}
+	var logs []string
+	for _, part := range []struct {
+		encoded string
+		value   interface{}
+	}{
+		{hint.Schema, &body.Schema},
+		{hint.Columns, &columns},
+		{hint.Rows, &rows},
+		{hint.RawLogs, &logs},
+	} {
+		decoder := json.NewDecoder(bytes.NewReader([]byte(part.encoded)))
+		decoder.UseNumber()
+		err := decoder.Decode(part.value)
+		if err != nil {
+			return body, nil, nil, nil, err
+		}
+	}
+
+	rawRows := make([][]interface{}, len(logs))
+	for i, raw := range logs {
+		rawRows[i] = []interface{}{hint.Family, raw}
+	}
+	return body, columns, rows, rawRows, nil
+}
+
+// markHint records that a shard holds hints for a replica
+func markHint(holderID string, key hintKey) {
+	pendingHintsLock.Lock()
+	defer pendingHintsLock.Unlock()
+	if pendingHints[holderID] == nil {
+		pendingHints[holderID] = map[hintKey]bool{}
+	}
+	pendingHints[holderID][key] = true
+}
+
+// behind reports whether hints are waiting for the replica of a family table
+// on the shard
+func behind(table string, shardID string) bool {
+	pendingHintsLock.RLock()
+	defer pendingHintsLock.RUnlock()
+	key := hintKey{Family: table, ShardID: shardID}
+	for _, keys := range pendingHints {
+		if keys[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// inSync leaves out the shards that are behind on any of the tables, or down,
+// unless that leaves none, in which case reading from one that is behind
+// beats failing the query
+func inSync(tables []string, shards []Shard) []Shard {
+	var synced []Shard
+	for _, shard := range shards {
+		current := true
+		for _, table := range tables {
+			if behind(strings.TrimSpace(table), shard.ID) {
+				current = false
+				break
+			}
+		}
+		if current && !shard.down() {
+			synced = append(synced, shard)
+		}
+	}
+	if len(synced) == 0 {
+		return shards
+	}
+	return synced
+}
+
+// replayHints reads which replicas every live shard holds hints for, which
+// may have been left by other instances, and replays a batch of them to the
+// replicas that are up. The hints of shards that can't be read are kept as
+// they were.
+func replayHints() {
+	for _, holder := range liveShards() {
+		var keys []hintKey
+		table := holder.DB.NewScope(&ReplicaHint{}).TableName()
+		err := holder.DB.Raw("SELECT DISTINCT family, shard_id FROM " + quoteIdentifier(table)).Scan(&keys).Error
+		if err != nil {
+			logrus.WithError(err).Warningf("Could not read the hints held by %s", holder.ID)
+			continue
+		}
+		pending := map[hintKey]bool{}
+		for _, key := range keys {
+			pending[key] = true
+		}
+		pendingHintsLock.Lock()
+		pendingHints[holder.ID] = pending
+		pendingHintsLock.Unlock()
+		if len(pending) == 0 {
+			continue
+		}
+
+		var hints []ReplicaHint
+		err = holder.DB.Order("id").Limit(hintBatch).Find(&hints).Error
+		if err != nil {
+			logrus.WithError(err).Warningf("Could not read the hints held by %s", holder.ID)
+			continue
+		}
+		for _, hint := range hints {
+			err = replayHint(holder, hint)
+			if err != nil {
+				logrus.WithError(err).Warningf("Could not replay the hint for the %s log family to %s", hint.Family, hint.ShardID)
+			}
+		}
+	}
+}
+
+// replayHint writes the events of a hint to the replica that missed them and
+// deletes the hint. The hint is locked meanwhile so that no other instance
+// replays it too. Should the delete fail once the events are written, they
+// are written again by the next replay. A hint for a shard that no longer
+// holds the family is dropped.
+func replayHint(holder Shard, hint ReplicaHint) error {
+	if !placedOn(hint.Family, hint.ShardID) {
+		logrus.Warningf("Dropping the hint for the %s log family, which is no longer on %s", hint.Family, hint.ShardID)
+		return holder.DB.Delete(&hint).Error
+	}
+	replicas, _ := replicasOf(hint.Family)
+	var target *replica
+	for i := range replicas {
+		if replicas[i].Shard.ID == hint.ShardID {
+			target = &replicas[i]
+		}
+	}
+	if target == nil {
+		// Down, so the hint waits for it to come back
+		return nil
+	}
+	body, columns, rows, rawRows, err := decodeHint(hint)
+	if err != nil {
+		return err
+	}
+
+	tx := holder.DB.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	var id uint
+	table := tx.NewScope(&ReplicaHint{}).TableName()
+	err = tx.Raw("SELECT id FROM "+quoteIdentifier(table)+" WHERE id = ? FOR UPDATE", hint.ID).Row().Scan(&id)
+	if err == sql.ErrNoRows {
+		// Replayed by another instance in the meantime
+		tx.Rollback()
+		return nil
+	}
+	if err == nil {
+		write := writeReplica(*target, body, false, columns, rows, rawRows)
+		err = write.Err
+		if err == nil && len(write.Conflicts) > 0 {
+			err = fmt.Errorf("the schema conflicts with the existing columns on the replica: %v", write.Conflicts)
+		}
+	}
+	if err == nil {
+		err = tx.Delete(&hint).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit().Error
+	if err == nil {
+		logrus.Infof("Replayed %d missed events of the %s log family to %s", len(rows), hint.Family, hint.ShardID)
+	}
+	return err
+}
+
+// hintLoop replays the hints every --hint_interval, starting straight away so
+// that the replicas left behind before a restart aren't read from
+func hintLoop() {
+	for {
+		replayHints()
+		time.Sleep(*hintInterval)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHintRoundTrip(t *testing.T) {
+	body := IngestLogBody{Family: "dog__20170109", Schema: map[string]string{"name": "string", "chip": "bigint"}}
+	columns := []string{"chip", "name", "time", "weight", "good"}
+	at := time.Date(2017, 1, 12, 18, 33, 55, 500000000, time.FixedZone("EST", -5*3600))
+	familyRows := [][]interface{}{
+		{int64(9007199254740993), "spot", at, 10.5, true},
+		{nil, "rex", at, nil, false},
+	}
+	rawRows := [][]interface{}{
+		{"dog__20170109", `{"name":"spot"}`},
+		{"dog__20170109", `{"name":"rex"}`},
+	}
+
+	hint, err := encodeHint(body, columns, familyRows, rawRows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedBody, decodedColumns, rows, decodedRawRows, err := decodeHint(hint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decodedBody.Family != body.Family || !reflect.DeepEqual(decodedBody.Schema, body.Schema) {
+		t.Errorf("got body %+v, expected %+v", decodedBody, body)
+	}
+	if !reflect.DeepEqual(decodedColumns, columns) {
+		t.Errorf("got columns %q, expected %q", decodedColumns, columns)
+	}
+	expected := [][]interface{}{
+		{json.Number("9007199254740993"), "spot", "2017-01-12 23:33:55.5", json.Number("10.5"), true},
+		{nil, "rex", "2017-01-12 23:33:55.5", nil, false},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("got rows %#v, expected %#v", rows, expected)
+	}
+	if !reflect.DeepEqual(decodedRawRows, rawRows) {
+		t.Errorf("got raw logs %q, expected %q", decodedRawRows, rawRows)
+	}
+}
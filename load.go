@@ -0,0 +1,244 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// How much each metric counts towards the load score of a shard. Every metric
+// is first scaled to the busiest shard, so these only set their relative
+// importance.
+const (
+	loadSizeFactor = 1.0
+	loadRowsFactor = 0.5
+	loadRateFactor = 1.0
+)
+
+// ingestRateMinutes is the window over which the ingest rates of shards and
+// families are measured
+const ingestRateMinutes = 10
+
+// shardLoad is what the placement strategies know about how busy a shard is
+type shardLoad struct {
+	ShardID  string `json:"shard_id"`
+	Families int    `json:"families"`
+	// DataBytes and Rows cover every table of the shard as reported by
+	// information_schema
+	DataBytes int64 `json:"data_bytes"`
+	Rows      int64 `json:"rows"`
+	// IngestRate is the number of events per second this instance has
+	// written to the shard over the last ingestRateMinutes
+	IngestRate float64           `json:"ingest_rate"`
+	Weight     float64           `json:"weight"`
+	Capacity   int64             `json:"capacity_bytes"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	// Utilization is DataBytes as a fraction of Capacity, or 0 when the
+	// shard has no configured capacity
+	Utilization float64 `json:"utilization"`
+	// Full is set once Utilization reaches --placement_high_water, after
+	// which the shard gets no new families
+	Full bool `json:"full"`
+	// Draining is set while the families of the shard are being moved off
+	// it, which also keeps new families away
+	Draining bool `json:"draining"`
+	// Score is the weighted load placement compares shards by, lower
+	// meaning less busy
+	Score float64 `json:"score"`
+}
+
+// rateBucket counts the events written during one minute
+type rateBucket struct {
+	Minute int64
+	Events int64
+}
+
+// rateMeter measures ingest rates with a ring of per-minute buckets for every
+// key it is given
+type rateMeter struct {
+	sync.Mutex
+	buckets map[string]*[ingestRateMinutes]rateBucket
+}
+
+// shardIngest and familyIngest measure the events this instance writes to
+// every shard and every family
+var (
+	shardIngest  = &rateMeter{buckets: map[string]*[ingestRateMinutes]rateBucket{}}
+	familyIngest = &rateMeter{buckets: map[string]*[ingestRateMinutes]rateBucket{}}
+)
+
+// record counts events towards the rate of key
+func (meter *rateMeter) record(key string, events int) {
+	minute := time.Now().Unix() / 60
+
+	meter.Lock()
+	defer meter.Unlock()
+
+	buckets, ok := meter.buckets[key]
+	if !ok {
+		buckets = &[ingestRateMinutes]rateBucket{}
+		meter.buckets[key] = buckets
+	}
+	bucket := &buckets[minute%ingestRateMinutes]
+	if bucket.Minute != minute {
+		*bucket = rateBucket{Minute: minute}
+	}
+	bucket.Events += int64(events)
+}
+
+// rate returns the events per second counted for key over the last
+// ingestRateMinutes
+func (meter *rateMeter) rate(key string) float64 {
+	minute := time.Now().Unix() / 60
+
+	meter.Lock()
+	defer meter.Unlock()
+
+	buckets, ok := meter.buckets[key]
+	if !ok {
+		return 0
+	}
+	var events int64
+	for _, bucket := range buckets {
+		if minute-bucket.Minute < ingestRateMinutes {
+			events += bucket.Events
+		}
+	}
+	return float64(events) / (ingestRateMinutes * 60)
+}
+
+// recordIngest counts events written to a family on a shard towards their
+// ingest rates
+func recordIngest(shardID string, family string, events int) {
+	shardIngest.record(shardID, events)
+	familyIngest.record(family, events)
+}
+
+// measureShard reads the size of a shard from information_schema
+func measureShard(shard Shard) (shardLoad, error) {
+	load := shardLoad{
+		ShardID:    shard.ID,
+		Families:   shard.Families.Size(),
+		IngestRate: shardIngest.rate(shard.ID),
+		Weight:     shard.Weight,
+		Capacity:   shard.Capacity,
+		Draining:   drainingShards.Has(shard.ID),
+		Tags:       shard.Tags,
+	}
+
+	row := shard.DB.Raw("SELECT COALESCE(SUM(DATA_LENGTH + INDEX_LENGTH), 0), COALESCE(SUM(TABLE_ROWS), 0) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE()").Row()
+	err := row.Scan(&load.DataBytes, &load.Rows)
+	if err != nil {
+		return load, err
+	}
+
+	if load.Capacity > 0 {
+		load.Utilization = float64(load.DataBytes) / float64(load.Capacity)
+		load.Full = load.Utilization >= *placementHighWater
+	}
+	return load, nil
+}
+
+// measureShards measures every connected shard that isn't down and scores
+// them against each other. Shards that can't be measured are logged and left
+// out.
+func measureShards() []shardLoad {
+	var loads []shardLoad
+	for _, shard := range liveShards() {
+		load, err := measureShard(shard)
+		if err != nil {
+			logrus.WithError(err).Warningf("Could not measure the load of %s", shard.ID)
+			continue
+		}
+		loads = append(loads, load)
+	}
+
+	scale := scaleOf(loads)
+	for i := range loads {
+		loads[i].Score = scale.score(loads[i].DataBytes, loads[i].Rows, loads[i].IngestRate, loads[i].Weight)
+	}
+
+	return loads
+}
+
+// loadScale holds the busiest figures across the shards, which every load
+// score is relative to
+type loadScale struct {
+	MaxBytes int64
+	MaxRows  int64
+	MaxRate  float64
+}
+
+// scaleOf finds the busiest figures across the shards
+func scaleOf(loads []shardLoad) loadScale {
+	var scale loadScale
+	for _, load := range loads {
+		if load.DataBytes > scale.MaxBytes {
+			scale.MaxBytes = load.DataBytes
+		}
+		if load.Rows > scale.MaxRows {
+			scale.MaxRows = load.Rows
+		}
+		if load.IngestRate > scale.MaxRate {
+			scale.MaxRate = load.IngestRate
+		}
+	}
+	return scale
+}
+
+// score weighs the size, rows and ingest rate of a shard into a single load
+// score, lower meaning less busy
+func (scale loadScale) score(dataBytes int64, rows int64, rate float64, weight float64) float64 {
+	var score float64
+	if scale.MaxBytes > 0 {
+		score += loadSizeFactor * float64(dataBytes) / float64(scale.MaxBytes)
+	}
+	if scale.MaxRows > 0 {
+		score += loadRowsFactor * float64(rows) / float64(scale.MaxRows)
+	}
+	if scale.MaxRate > 0 {
+		score += loadRateFactor * rate / scale.MaxRate
+	}
+	return score / weight
+}
+
+// leastLoaded returns up to n shards that aren't full or draining, lowest
+// load score first, preferring the one with fewer families and then the lower
+// ID on a tie
+func leastLoaded(loads []shardLoad, n int) []shardLoad {
+	var candidates []shardLoad
+	for _, load := range loads {
+		if !load.Full && !load.Draining {
+			candidates = append(candidates, load)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Score != b.Score {
+			return a.Score < b.Score
+		}
+		if a.Families != b.Families {
+			return a.Families < b.Families
+		}
+		return a.ShardID < b.ShardID
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+// ListShards is the admin handler showing the load of every connected shard
+func ListShards(c *gin.Context) {
+	loads := measureShards()
+	if loads == nil {
+		loads = []shardLoad{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"shards": loads,
+	})
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
-	"strconv"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -27,17 +29,90 @@ var (
 	dbName        = cli.Flag("mysql_databases", "The MySQL database to use Ex. 'dbA:3306,dbB:3306'").Default("databalancer,databalancer2").String()
 	serverAddress = cli.Flag("server_address", "The address and port to serve the local HTTP server").Default(":8080").String()
 	purge         = cli.Flag("purge", "Would you like to purge old data?").Short('p').Bool()
+	retention     = cli.Flag("retention", "How old events get before --purge deletes them").Default("168h").Duration()
+
+	configFile = cli.Flag("config", "A YAML file with the shards, retention, limits, auth and logging settings; flags take precedence over it").String()
+	configPoll = cli.Flag("config_poll", "How often --config is checked for changes to reload").Default("10s").Duration()
+
+	apiTokens   = cli.Flag("api_token", "A bearer token clients must send to use the service. May be repeated.").Strings()
+	adminTokens = cli.Flag("admin_token", "A bearer token that also allows using /api/admin. May be repeated.").Strings()
+
+	logLevel  = cli.Flag("log_level", "The least severe messages that are logged: debug, info, warning or error").Default("info").Enum("debug", "info", "warning", "error")
+	logFormat = cli.Flag("log_format", "How messages are logged: text or json").Default(logText).Enum(logText, logJSON)
+
+	autoMigrate = cli.Flag("auto_migrate", "Apply pending schema migrations to every shard at startup and when it is connected to").Default("true").Bool()
+
+	serveCommand   = cli.Command("serve", "Run the service").Default()
+	migrateCommand = cli.Command("migrate", "Apply pending schema migrations to every shard and exit")
+	migrateDryRun  = migrateCommand.Flag("dry_run", "Only list the pending schema migrations").Bool()
+	wipeCommand    = cli.Command("wipe-raw-logs", "Delete the raw logs of every shard, or of the shards given with --shard, and exit")
+	wipeShards     = wipeCommand.Flag("shard", "The ID of a shard to wipe. May be repeated.").Strings()
+	wipeConfirm    = wipeCommand.Flag("yes", "Confirm that the raw logs should be deleted, which can't be undone").Bool()
+
+	insertChunkSize = cli.Flag("insert_chunk_size", "The maximum number of log events written by a single INSERT statement").Default("500").Int()
+
+	dbReadUsername = cli.Flag("mysql_read_username", "An optional read-only MySQL user account used for /api/query").String()
+	dbReadPassword = cli.Flag("mysql_read_password", "The password of the read-only MySQL user account").String()
+
+	shardsFile = cli.Flag("shards_file", "A YAML or JSON file listing every shard with its own address, database, credentials, weight and tags, used instead of --mysql_address and --mysql_databases").String()
+
+	queryTimeout    = cli.Flag("query_timeout", "How long a query may run when the request doesn't set timeout_ms").Default("30s").Duration()
+	maxQueryTimeout = cli.Flag("max_query_timeout", "The longest timeout_ms a query request may ask for").Default("5m").Duration()
+
+	placementStrategy  = cli.Flag("placement", "How new families are assigned to shards: least_tables, consistent_hash or load_aware").Default(placementLeastTables).Enum(placementLeastTables, placementConsistentHash, placementLoadAware)
+	placementVnodes    = cli.Flag("placement_vnodes", "The number of virtual nodes each shard gets on the consistent hash ring").Default("128").Int()
+	placementHighWater = cli.Flag("placement_high_water", "The fraction of its --shard_capacity a shard may fill before it gets no new families").Default("0.85").Float64()
+	shardWeights       = cli.Flag("shard_weight", "How much load a shard should take relative to the others, as shard_id=weight. May be repeated.").StringMap()
+	shardCapacities    = cli.Flag("shard_capacity", "The amount of data a shard can hold, as shard_id=size such as localhost:3306/databalancer=500GB. May be repeated.").StringMap()
+
+	replicationFactor = cli.Flag("replication_factor", "The number of shards a new family is written to when the ingest request doesn't set replicas").Default("1").Int()
+	writeAck          = cli.Flag("write_ack", "How many replicas must store the events of an ingest request before it succeeds: one, quorum or all").Default(ackQuorum).Enum(ackOne, ackQuorum, ackAll)
+
+	healthInterval = cli.Flag("health_interval", "How often every shard is pinged, and unreachable shards are connected to").Default("5s").Duration()
+	healthTimeout  = cli.Flag("health_timeout", "How long a health check ping may take before it counts as failed").Default("2s").Duration()
+	healthFall     = cli.Flag("health_fall", "The number of failed health checks in a row that mark a shard down").Default("3").Int()
+	healthRise     = cli.Flag("health_rise", "The number of passed health checks in a row that mark a shard up again").Default("2").Int()
+
+	hintInterval = cli.Flag("hint_interval", "How often the events replicas missed are replayed to them").Default("10s").Duration()
+
+	catalogRefresh = cli.Flag("catalog_refresh", "How often the placement catalog is read back from every shard, to pick up the changes other instances made").Default("30s").Duration()
+
+	rebalance            = cli.Flag("rebalance", "Periodically move families off the busiest shards").Bool()
+	rebalanceInterval    = cli.Flag("rebalance_interval", "How often the rebalancer looks at the load of the shards").Default("1h").Duration()
+	rebalanceThreshold   = cli.Flag("rebalance_threshold", "The difference in load score between the busiest and least busy shard the rebalancer leaves alone").Default("0.25").Float64()
+	rebalanceMaxMoves    = cli.Flag("rebalance_max_moves", "The most families a single rebalance moves").Default("5").Int()
+	rebalanceConcurrency = cli.Flag("rebalance_concurrency", "The most families the rebalancer moves at the same time").Default("1").Int()
+	rebalanceThrottle    = cli.Flag("rebalance_throttle", "How long the rebalancer waits between batches of rows it copies").Default("100ms").Duration()
 )
 
 // db is the global database connection object
 //var db *gorm.DB
 type Shard struct {
-	DB       *gorm.DB
+	// ID names the shard as address/database, e.g. "localhost:3306/databalancer"
+	ID string
+	DB *gorm.DB
+	// ReadDB connects as the read-only user when one is configured and is
+	// used for client queries instead of DB
+	ReadDB *gorm.DB
+	// Weight and Capacity come from the topology or --shard_weight and
+	// --shard_capacity; a Capacity of 0 means the shard has no known limit
+	Weight   float64
+	Capacity int64
+	// Tags are the labels the topology gives the shard
+	Tags map[string]string
+	// Families mirrors the placement catalog entries of the shard
 	Families *set.Set
-	status   bool
+	// Health is kept up to date by the health checker and shared by every
+	// copy of the shard
+	Health *shardHealth
 }
 
-var databases []Shard
+// databases holds every connected shard. The health checker adds shards that
+// were unreachable at startup, so it is read through connectedShards.
+var (
+	databases     []Shard
+	databasesLock sync.RWMutex
+)
 
 // RawLog is an example struct which is used to store raw logs in the database
 type RawLog struct {
@@ -46,10 +121,14 @@ type RawLog struct {
 	Log    string
 }
 
-// Any tables in this array will automatically be dropped and re-created every
-// time the binary starts. This may become undesired behavior eventually.
-var databaseTables = [...]interface{}{
+// databaseTables are the tables the service keeps for itself on every shard,
+// created and changed by the schema migrations
+var databaseTables = []interface{}{
 	&RawLog{},
+	&FamilyPlacement{},
+	&SchemaVersion{},
+	&ShardState{},
+	&ReplicaHint{},
 }
 
 // IngestLogBody is the format of the JSON required in the body of a request to
@@ -58,32 +137,68 @@ type IngestLogBody struct {
 	Family string                   `json:"family" binding:"required"`
 	Schema map[string]string        `json:"schema" binding:"required"`
 	Logs   []map[string]interface{} `json:"logs" binding:"required"`
+
+	// TimestampField optionally names the schema field holding the time of
+	// each event, which is then stored in the time column of the family
+	TimestampField string `json:"timestamp_field"`
+	// TimestampFormat is how event times are written: rfc3339 (the default),
+	// unix, unix_ms or a Go reference time layout
+	TimestampFormat string `json:"timestamp_format"`
+	// Partition optionally splits a new family into a table per day, week or
+	// month of event time, each placed on a shard of its own
+	Partition string `json:"partition"`
+	// Replicas optionally sets how many shards a new family is written to,
+	// overriding --replication_factor
+	Replicas int `json:"replicas"`
+	// Ack is one, quorum or all and overrides --write_ack for this request
+	Ack string `json:"ack"`
 }
 
 type QueryBody struct {
 	SQL string `json:"sql_query" binding:"required"`
+	// FanOut sends the query to every shard holding the families it reads
+	// and merges the rows, instead of answering it from the first one found
+	FanOut bool `json:"fan_out"`
+	// Format is json, ndjson or csv and takes precedence over the Accept
+	// header of the request
+	Format string `json:"format"`
+	// PageSize turns on pagination, returning at most this many rows along
+	// with a cursor to pass back for the next page
+	PageSize int    `json:"page_size"`
+	Cursor   string `json:"cursor"`
+	// TimeoutMs overrides the server's default query timeout, up to the
+	// maximum it allows
+	TimeoutMs int `json:"timeout_ms"`
+}
+
+// StructuredQueryBody is a query document for families, for clients that
+// would rather not write SQL. It is compiled to a parameterized SELECT by
+// compileStructuredQuery.
+type StructuredQueryBody struct {
+	Family string   `json:"family" binding:"required"`
+	Fields []string `json:"fields"`
+	// Filter and TimeRange are both optional and combined with AND
+	Filter     *dslFilter     `json:"filter"`
+	TimeRange  *dslTimeRange  `json:"time_range"`
+	GroupBy    []string       `json:"group_by"`
+	Aggregates []dslAggregate `json:"aggregates"`
+	Order      []dslOrder     `json:"order"`
+	Limit      int            `json:"limit"`
+	// FanOut, Format and TimeoutMs work the same way as in QueryBody
+	FanOut    bool   `json:"fan_out"`
+	Format    string `json:"format"`
+	TimeoutMs int    `json:"timeout_ms"`
 }
 type PurgeOpt struct {
 	Family string `json:"family" binding:"required"`
 	Date   string `json:"date" binding:"required"`
 }
 
-func findFamily(familyName string) (sharder Shard) {
-	for _, shard := range databases {
-		if shard.DB.HasTable(familyName) {
-			shard.Families.Add(familyName)
-			return shard
-		}
-	}
-	return sharder
-}
-
 //So, let's distribute these tables a tad better
-func evenShuffle() (sharder Shard) {
-	findExisting()
-	smallest := databases[0].Families.Size()
-	sharder = databases[0]
-	for _, shard := range databases {
+func evenShuffle(candidates []Shard) (sharder Shard) {
+	smallest := candidates[0].Families.Size()
+	sharder = candidates[0]
+	for _, shard := range candidates {
 		if shard.Families.Size() < smallest {
 			smallest = shard.Families.Size()
 			sharder = shard
@@ -92,24 +207,231 @@ func evenShuffle() (sharder Shard) {
 	return sharder
 }
 
-func createNewTable(body IngestLogBody) (sharder Shard) {
-	sharder = evenShuffle()
-	createString := "create table " + body.Family + " ( "
-	createString = createString + " id INT NOT NULL AUTO_INCREMENT, "
+// createNewTable places a new family on as many shards as placement.Replicas
+// asks for and creates its table on each of them. Either every replica is
+// created or none is.
+func createNewTable(body IngestLogBody, placement FamilyPlacement) (replicas []Shard, err error) {
+	replicas, err = placeFamily(body.Family, placement.Replicas)
+	if err != nil {
+		return nil, err
+	}
+	for i, sharder := range replicas {
+		err = createReplica(sharder, body, placement)
+		if err != nil {
+			for _, created := range replicas[:i] {
+				created.DB.Exec(fmt.Sprintf("DROP TABLE %s", quoteIdentifier(body.Family)))
+				removePlacement(created, body.Family)
+			}
+			return nil, err
+		}
+	}
+	return replicas, nil
+}
+
+// createReplica creates the table of a new family on a single shard and adds
+// it to the catalog
+func createReplica(sharder Shard, body IngestLogBody, placement FamilyPlacement) error {
+	columns := []string{"id INT NOT NULL AUTO_INCREMENT"}
 	for column, columnType := range body.Schema {
 		logrus.Debugf("Log values for the field %s of the %s log will be of type %s", column, body.Family, columnType)
-		switch columnType {
-		case "string":
-			createString = createString + " " + column + " varchar(255),"
-		case "int":
-			createString = createString + " " + column + " INT,"
+		mapping, err := columnFor(sharder.DB, columnType)
+		if err != nil {
+			return err
 		}
+		columns = append(columns, quoteIdentifier(column)+" "+mapping.Definition)
+	}
+	columns = append(columns, "time TIMESTAMP", "PRIMARY KEY (id)", "KEY (id)")
+	createString := fmt.Sprintf("create table %s ( %s )", quoteIdentifier(body.Family), strings.Join(columns, ", "))
+	err := sharder.DB.Exec(createString).Error
+	if err != nil {
+		return err
+	}
+	err = recordPlacement(sharder, placement, body.Schema)
+	if err != nil {
+		// Without a catalog row nobody would ever find the table, so drop it
+		// and let the next request for the family start over
+		sharder.DB.Exec(fmt.Sprintf("DROP TABLE %s", quoteIdentifier(body.Family)))
+		return err
+	}
+	return nil
+}
+
+// encodeEvent checks a single log event against the family schema and returns
+// the values to bind for it keyed by column name. Problems with individual
+// fields are returned keyed by field name.
+func encodeEvent(body IngestLogBody, logEvent map[string]interface{}) (map[string]interface{}, map[string]string) {
+	fieldErrors := map[string]string{}
+	values := make(map[string]interface{}, len(logEvent))
+
+	for field, value := range logEvent {
+		if field == eventTimestampKey {
+			// Handled by eventTime rather than stored in a column of its own
+			continue
+		}
+
+		columnType, ok := body.Schema[field]
+		if !ok {
+			fieldErrors[field] = fmt.Sprintf(
+				"Data type for the field %s was not specified in the %s schema map",
+				field,
+				body.Family,
+			)
+			continue
+		}
+
+		encoded, err := encodeValue(columnType, value)
+		if err != nil {
+			fieldErrors[field] = fmt.Sprintf("Invalid value for the field %s: %s", field, err)
+			continue
+		}
+
+		logrus.Debugf("The value of the %s field in the %s log event is %v", field, body.Family, encoded)
+		values[field] = encoded
+	}
+
+	return values, fieldErrors
+}
+
+// insertRows writes rows into table using multi-row INSERT statements of at
+// most chunkSize rows each. Every value is bound as a parameter and every
+// identifier has already been checked by validateSchema, so nothing from the
+// request is spliced into the SQL as-is.
+func insertRows(db *gorm.DB, table string, columns []string, rows [][]interface{}, chunkSize int) error {
+	return insertChunks(db, table, columns, rows, chunkSize, "")
+}
+
+// insertMissingRows writes rows that carry their id into table like
+// insertRows, leaving alone those whose id the table already has. Migrations
+// use it for rows that reach the target both from the copy and from the
+// writes mirrored to it, which are the same row of the source either way.
+func insertMissingRows(db *gorm.DB, table string, columns []string, rows [][]interface{}, chunkSize int) error {
+	return insertChunks(db, table, columns, rows, chunkSize, " ON DUPLICATE KEY UPDATE `id` = `id`")
+}
+
+// insertEach writes rows into table one INSERT at a time and returns the id
+// given to each of them, which a multi-row INSERT can't tell reliably
+func insertEach(db *gorm.DB, table string, columns []string, rows [][]interface{}) ([]int64, error) {
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdentifier(column)
+		placeholders[i] = "?"
+	}
+	statement := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteIdentifier(table), strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+
+	ids := make([]int64, len(rows))
+	for i, row := range rows {
+		result, err := db.CommonDB().Exec(statement, row...)
+		if err != nil {
+			return nil, err
+		}
+		ids[i], err = result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// insertChunks does the work of insertRows, adding suffix to every INSERT
+func insertChunks(db *gorm.DB, table string, columns []string, rows [][]interface{}, chunkSize int, suffix string) error {
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdentifier(column)
+		placeholders[i] = "?"
+	}
+	rowPlaceholder := "(" + strings.Join(placeholders, ", ") + ")"
+	prefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", quoteIdentifier(table), strings.Join(quoted, ", "))
+
+	for start := 0; start < len(rows); start += chunkSize {
+		end := start + chunkSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		chunk := rows[start:end]
+		tuples := make([]string, len(chunk))
+		values := make([]interface{}, 0, len(chunk)*len(columns))
+		for i, row := range chunk {
+			tuples[i] = rowPlaceholder
+			values = append(values, row...)
+		}
+
+		err := db.Exec(prefix+strings.Join(tuples, ", ")+suffix, values...).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeEvents writes the rows of an ingest request into the family table and
+// the raw logs table of a replica. Both tables are written in a single
+// transaction so a failure part way through leaves neither of them with a
+// partial request. The transaction starts by checking the placement of the
+// family with checkPlacement, and while the family is migrating it mirrors
+// the rows to the incoming shard before it commits.
+func writeEvents(written replica, family string, columns []string, familyRows [][]interface{}, rawRows [][]interface{}) error {
+	tx := written.Shard.DB.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	rawLogTable := tx.NewScope(&RawLog{}).TableName()
+	chunkSize := currentSettings().InsertChunkSize
+	err := checkPlacement(tx, family, written.Status)
+	if err == nil {
+		err = insertRows(tx, rawLogTable, []string{"family", "log"}, rawRows, chunkSize)
+	}
+	if err == nil && written.Incoming == nil {
+		err = insertRows(tx, family, columns, familyRows, chunkSize)
+	}
+	if err == nil && written.Incoming != nil {
+		var ids []int64
+		ids, err = insertEach(tx, family, columns, familyRows)
+		if err == nil {
+			mirrorEvents(*written.Incoming, family, columns, ids, familyRows, rawRows)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// mirrorEvents writes the rows just written to a migrating family to the
+// shard it is migrating to, with the ids they were given. It runs before the
+// write to the source commits, so a migration holding the catalog row of the
+// source knows no mirrored write is in flight. A failure is only logged: it
+// leaves the copy short, which fails the migration rather than the request.
+func mirrorEvents(incoming Shard, family string, columns []string, ids []int64, familyRows [][]interface{}, rawRows [][]interface{}) {
+	rows := make([][]interface{}, len(familyRows))
+	for i, row := range familyRows {
+		rows[i] = append([]interface{}{ids[i]}, row...)
+	}
+
+	tx := incoming.DB.Begin()
+	err := tx.Error
+	if err == nil {
+		rawLogTable := tx.NewScope(&RawLog{}).TableName()
+		chunkSize := currentSettings().InsertChunkSize
+		err = insertRows(tx, rawLogTable, []string{"family", "log"}, rawRows, chunkSize)
+		if err == nil {
+			err = insertMissingRows(tx, family, append([]string{"id"}, columns...), rows, chunkSize)
+		}
+		if err == nil {
+			err = tx.Commit().Error
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		logrus.WithError(err).Warningf("Could not mirror the events of the migrating %s family to %s", family, incoming.ID)
 	}
-	createString = createString + " time TIMESTAMP, "
-	createString = createString + " PRIMARY KEY (id) , KEY (id) )"
-	sharder.DB.Exec(strings.Replace(createString, ",)", ")", 1))
-	sharder.Families.Add(body.Family)
-	return sharder
 }
 
 // IngestLog is an HTTP handler which ingests logs from other micro-services
@@ -125,57 +447,52 @@ func IngestLog(c *gin.Context) {
 
 	logrus.Debugf("Received logs for the %s log family", body.Family)
 
-	//get existing family names
-	sharder := findFamily(body.Family)
-
-	if !sharder.status {
-		sharder = createNewTable(body)
+	fieldErrors := validateSchema(body)
+	for option, message := range validateTimestamp(body) {
+		fieldErrors[option] = message
+	}
+	for option, message := range validatePartition(body) {
+		fieldErrors[option] = message
+	}
+	for option, message := range validateReplication(body) {
+		fieldErrors[option] = message
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": fmt.Sprintf("The schema for the %s log family is invalid", body.Family),
+			"errors":  fieldErrors,
+		})
+		return
 	}
 
-	for _, logEvent := range body.Logs {
+	// Encode every event up front so that a bad event rejects the whole
+	// request before anything is written
+	events := make([]map[string]interface{}, len(body.Logs))
+	rawRows := make([][]interface{}, len(body.Logs))
+	columnSet := map[string]bool{"time": true}
+	received := time.Now()
+	for i, logEvent := range body.Logs {
 		logrus.Debugf("Handling a new log event for the %s log family", body.Family)
-		insertColumn := "INSERT INTO " + body.Family + " ( "
-		insertValues := "Values ("
-
-		for field, value := range logEvent {
-			insertColumn = insertColumn + field + ","
-			columnType, ok := body.Schema[field]
-
-			if !ok {
-				c.JSON(http.StatusBadRequest, map[string]string{
-					"message": fmt.Sprintf(
-						"Data type for the field %s was not specified in the %s schema map",
-						field,
-						body.Family,
-					),
-				})
-
-				return
-			}
-
-			switch columnType {
-			case "string":
-				logrus.Debugf("The value of the %s field in the %s log event is %s", field, body.Family, value.(string))
-				insertValues = insertValues + `"` + value.(string) + `",`
-			case "int":
-				logrus.Debugf("The value of the %s field in the %s log event is %d", field, body.Family, int(value.(float64)))
-				insertValues = insertValues + strconv.Itoa(int(value.(float64))) + ","
-			default:
-				c.JSON(http.StatusBadRequest, map[string]string{
-					"message": fmt.Sprintf("Unsupported data type in %s log for the field %s: %s", body.Family, field, columnType),
-				})
-
-				return
-			}
+		values, fieldErrors := encodeEvent(body, logEvent)
+		at, err := eventTime(body, logEvent, received)
+		if err != nil {
+			fieldErrors[eventTimestampKey] = fmt.Sprintf("Invalid event time: %s", err)
 		}
-
-		insertValues = insertValues + ")"
-		insertColumn = insertColumn + ")"
-		bigInsert := strings.Replace(insertColumn, ",)", ")", -1) + strings.Replace(insertValues, ",)", ")", -1)
+		values["time"] = at
+		if len(fieldErrors) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": fmt.Sprintf("Log event %d of the %s log family is invalid", i, body.Family),
+				"errors":  fieldErrors,
+			})
+			return
+		}
+		for column := range values {
+			columnSet[column] = true
+		}
+		events[i] = values
 
 		// Marshal the log event back into JSON to store it in the database
 		rawLogContent, err := json.Marshal(logEvent)
-
 		if err != nil {
 			logrus.WithError(err).Errorln("Could not marshal the log event into JSON")
 			c.JSON(http.StatusInternalServerError, map[string]string{
@@ -183,29 +500,284 @@ func IngestLog(c *gin.Context) {
 			})
 			return
 		}
+		rawRows[i] = []interface{}{body.Family, string(rawLogContent)}
+	}
 
-		rawLog := RawLog{
-			Family: body.Family,
-			Log:    string(rawLogContent),
-		}
+	// Multi-row inserts need the same columns in every row, so fields an event
+	// doesn't carry are written as NULL
+	columns := make([]string, 0, len(columnSet))
+	for column := range columnSet {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
 
-		err = sharder.DB.Create(&rawLog).Error
-		if err != nil {
-			logrus.WithError(err).Errorln("Cold not store the log event in the database")
+	familyRows := make([][]interface{}, len(events))
+	for i, values := range events {
+		row := make([]interface{}, len(columns))
+		for j, column := range columns {
+			row[j] = values[column]
+		}
+		familyRows[i] = row
+	}
 
-			c.JSON(http.StatusInternalServerError, map[string]string{
-				"message": "Database error",
+	// A family can't change how it is partitioned once it exists
+	partition := body.Partition
+	if existing := partitionOf(body.Family); existing != "" {
+		if partition != "" && partition != existing {
+			c.JSON(http.StatusConflict, map[string]string{
+				"message": fmt.Sprintf("The %s log family is partitioned by %s", body.Family, existing),
 			})
-
 			return
 		}
-		sharder.DB.Exec(bigInsert)
+		partition = existing
+	} else if partition != "" && len(placementsOf(body.Family)) > 0 {
+		c.JSON(http.StatusConflict, map[string]string{
+			"message": fmt.Sprintf("The %s log family already exists without partitioning", body.Family),
+		})
+		return
+	}
+
+	// Nor how many replicas it has
+	replicas := replicationOf(body.Family)
+	if replicas == 0 {
+		replicas = body.Replicas
+		if replicas == 0 {
+			replicas = *replicationFactor
+		}
+	} else if body.Replicas != 0 && body.Replicas != replicas {
+		c.JSON(http.StatusConflict, map[string]string{
+			"message": fmt.Sprintf("The %s log family has %d replicas", body.Family, replicas),
+		})
+		return
+	}
+
+	// Events of a partitioned family go to the table of their time bucket,
+	// each of which is written separately
+	tables := map[string]FamilyPlacement{}
+	tableRows := map[string][]int{}
+	for i, values := range events {
+		table := FamilyPlacement{Family: body.Family}
+		if partition != "" {
+			table = bucketTable(body.Family, partition, values["time"].(time.Time))
+		}
+		table.Replicas = replicas
+		tables[table.Family] = table
+		tableRows[table.Family] = append(tableRows[table.Family], i)
+	}
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// A bucket that fails doesn't stop the others from being written, and the
+	// response then says which events were stored so that only the others
+	// are sent again
+	var firstFailure *ingestFailure
+	failures := map[string]interface{}{}
+	storedBuckets := []string{}
+	storedEvents := []int{}
+	for _, name := range names {
+		familySubset := make([][]interface{}, len(tableRows[name]))
+		rawSubset := make([][]interface{}, len(tableRows[name]))
+		for i, row := range tableRows[name] {
+			familySubset[i] = familyRows[row]
+			rawSubset[i] = []interface{}{name, rawRows[row][1]}
+		}
+
+		failure := storeEvents(body, tables[name], columns, familySubset, rawSubset)
+		if failure != nil {
+			if firstFailure == nil {
+				firstFailure = failure
+			}
+			failures[name] = failure.Response
+			continue
+		}
+		storedBuckets = append(storedBuckets, name)
+		storedEvents = append(storedEvents, tableRows[name]...)
+	}
 
+	if firstFailure != nil {
+		if partition == "" {
+			c.JSON(firstFailure.Status, firstFailure.Response)
+			return
+		}
+		sort.Ints(storedEvents)
+		c.JSON(firstFailure.Status, gin.H{
+			"message":        fmt.Sprintf("%d of the %d time buckets of the %s log family could not be stored", len(failures), len(names), body.Family),
+			"failures":       failures,
+			"stored_buckets": storedBuckets,
+			"stored_events":  storedEvents,
+		})
+		return
 	}
+
 	c.JSON(http.StatusOK, map[string]string{
 		"message": "OK",
 	})
 }
+
+// ingestFailure is the response to an ingest request whose events couldn't be
+// stored
+type ingestFailure struct {
+	Status   int
+	Response interface{}
+}
+
+// storeEvents writes the rows of an ingest request into every replica of a
+// family table, creating the table or adding the columns it is missing first.
+// The table is the family itself or one of its time buckets, as described by
+// placement. The request succeeds once as many replicas as its ack asks for
+// have stored the rows.
+func storeEvents(body IngestLogBody, placement FamilyPlacement, columns []string, familyRows [][]interface{}, rawRows [][]interface{}) *ingestFailure {
+	table := placement.Family
+	tableBody := body
+	tableBody.Family = table
+
+	// Held while the events are written so that the table can't be created
+	// by another request in the meantime
+	lock := familyLock(table)
+	lock.RLock()
+	replicas, factor := replicasOf(table)
+	if factor == 0 {
+		// A new family is created under the write lock, and the catalog
+		// checked again once it is held, so that concurrent first requests
+		// for the family don't both create it
+		lock.RUnlock()
+		lock.Lock()
+		defer lock.Unlock()
+		replicas, factor = replicasOf(table)
+	} else {
+		defer lock.RUnlock()
+	}
+
+	created := false
+	if factor == 0 {
+		shards, err := createNewTable(tableBody, placement)
+		if _, ok := err.(*placementError); ok {
+			logrus.WithError(err).Warning("Could not place a new log family")
+			return &ingestFailure{Status: http.StatusServiceUnavailable, Response: map[string]string{
+				"message": err.Error(),
+			}}
+		}
+		if err != nil {
+			logrus.WithError(err).Errorf("Could not create the table for the %s log family", table)
+			return &ingestFailure{Status: http.StatusInternalServerError, Response: map[string]string{
+				"message": "Database error",
+			}}
+		}
+		for _, shard := range shards {
+			replicas = append(replicas, replica{Shard: shard, Status: placementActive})
+		}
+		factor, created = len(replicas), true
+	}
+
+	// A write fails as moved when another instance moved the family, or
+	// started or finished moving it. Its placements are then read back from
+	// the shards, and the replicas that haven't stored the events yet are
+	// tried once more.
+	stored := map[string]bool{}
+	moved := false
+	for attempt := 0; attempt < 2; attempt++ {
+		writes := make([]replicaWrite, len(replicas))
+		var writing sync.WaitGroup
+		for i, written := range replicas {
+			writing.Add(1)
+			go func(i int, written replica) {
+				defer writing.Done()
+				writes[i] = writeReplica(written, tableBody, created, columns, familyRows, rawRows)
+			}(i, written)
+		}
+		writing.Wait()
+
+		moved = false
+		for i, write := range writes {
+			if len(write.Conflicts) > 0 {
+				return &ingestFailure{Status: http.StatusConflict, Response: gin.H{
+					"message":   fmt.Sprintf("The schema conflicts with the existing columns of the %s log family", table),
+					"conflicts": write.Conflicts,
+				}}
+			}
+			if write.Err != nil {
+				logrus.WithError(write.Err).Errorf("Could not store the log events for the %s log family on %s", table, replicas[i].Shard.ID)
+				moved = moved || placementMoved(write.Err)
+				continue
+			}
+			stored[replicas[i].Shard.ID] = true
+			recordIngest(replicas[i].Shard.ID, body.Family, len(rawRows))
+		}
+		if !moved {
+			break
+		}
+
+		forgetPlacements(table)
+		var current []replica
+		current, factor = replicasOf(table)
+		replicas = nil
+		for _, written := range current {
+			if !stored[written.Shard.ID] {
+				replicas = append(replicas, written)
+			}
+		}
+	}
+	acked := len(stored)
+	if factor > 1 && acked > 0 {
+		missed := missedReplicas(table, stored)
+		if len(missed) > 0 {
+			leaveHints(tableBody, stored, missed, columns, familyRows, rawRows)
+		}
+	}
+
+	required := requiredAcks(body.Ack, factor)
+	if acked < required {
+		if moved {
+			return &ingestFailure{Status: http.StatusServiceUnavailable, Response: map[string]string{
+				"message": fmt.Sprintf("The %s log family is being moved to another shard, try again", table),
+			}}
+		}
+		if factor == 1 && len(replicas) == 1 {
+			return &ingestFailure{Status: http.StatusInternalServerError, Response: map[string]string{
+				"message": "Database error",
+			}}
+		}
+		return &ingestFailure{Status: http.StatusServiceUnavailable, Response: map[string]string{
+			"message": fmt.Sprintf("Only %d of the %d replicas of the %s log family stored the events, %d were needed", acked, factor, table, required),
+		}}
+	}
+	if acked < factor {
+		logrus.Warningf("Only %d of the %d replicas of the %s log family stored the events", acked, factor, table)
+	}
+	return nil
+}
+
+// replicaWrite is the outcome of writing events to a single replica
+type replicaWrite struct {
+	Conflicts map[string]string
+	Err       error
+}
+
+// writeReplica writes the rows of an ingest request to one replica of a
+// family table, first making sure the table has every field the request
+// declares unless it was only just created. The copy a migration is making
+// of the table gets the fields first, so the copy never reads a column from
+// the table that its copy doesn't have yet.
+func writeReplica(written replica, body IngestLogBody, created bool, columns []string, familyRows [][]interface{}, rawRows [][]interface{}) replicaWrite {
+	if written.Incoming != nil {
+		conflicts, err := evolveSchema(written.Incoming.DB, body)
+		if err != nil || len(conflicts) > 0 {
+			logrus.WithError(err).Warningf("Could not add the new fields of the migrating %s family to %s", body.Family, written.Incoming.ID)
+			written.Incoming = nil
+		}
+	}
+	if !created {
+		conflicts, err := evolveSchema(written.Shard.DB, body)
+		if err != nil || len(conflicts) > 0 {
+			return replicaWrite{Conflicts: conflicts, Err: err}
+		}
+	}
+	return replicaWrite{Err: writeEvents(written, body.Family, columns, familyRows, rawRows)}
+}
+
 func QueryMagic(c *gin.Context) {
 	var body QueryBody
 
@@ -214,140 +786,344 @@ func QueryMagic(c *gin.Context) {
 		logrus.WithError(err).Errorf("The request did not contain a correctly formatted JSON body")
 		return
 	}
-	var sharder Shard
-	findExisting()
-	//We have to break out of the nested loop something how
-	targetTable := strings.Split(body.SQL, "from ")
-	if len(targetTable) != 2 {
-		c.JSON(http.StatusNotFound, map[string]string{
-			"message": "you have a malformed sql query",
+	plan, err := planQuery(body.SQL)
+	if err != nil {
+		if parseErr, ok := err.(*sqlError); ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message":  parseErr.Message,
+				"position": parseErr.Position,
+				"line":     parseErr.Line,
+				"column":   parseErr.Column,
+				"near":     parseErr.Near,
+			})
+			return
+		}
+		c.JSON(http.StatusBadRequest, map[string]string{
+			"message": err.Error(),
 		})
 		return
 	}
 
-	subString := targetTable[1]
-	tableName := strings.Split(subString, " where")[0]
+	err = authorizeQuery(plan.Statement)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"client": c.ClientIP(),
+			"sql":    body.SQL,
+		}).WithError(err).Warning("Denied a query")
+		c.JSON(http.StatusForbidden, map[string]string{
+			"message": err.Error(),
+		})
+		return
+	}
 
-LOOP:
-	for _, shard := range databases {
-		for _, x := range shard.Families.List() {
-			if strings.TrimSpace(tableName) == strings.TrimSpace(x.(string)) {
-				sharder = shard
-				break LOOP
-			}
-		}
+	format, err := negotiateFormat(c, body.Format)
+	if err != nil {
+		c.JSON(http.StatusNotAcceptable, map[string]string{
+			"message": err.Error(),
+		})
+		return
+	}
 
+	from, to := timeBounds(plan.Statement)
+	targets, merge, status, err := routeQuery(plan.Tables, body.FanOut, from, to)
+	if err != nil {
+		c.JSON(status, map[string]string{
+			"message": err.Error(),
+		})
+		return
+	}
+	paginated := body.PageSize > 0 || body.Cursor != ""
+	partitioned := targets[0].Tables[0] != plan.Tables[0]
+	if paginated && partitioned {
+		c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "queries over a partitioned family can't be paginated",
+		})
+		return
+	}
+	err = targetQueries(targets, body.SQL, plan, merge)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, map[string]string{
+			"message": err.Error(),
+		})
+		return
 	}
-	if sharder.status {
 
-		rows, err := sharder.DB.Raw(body.SQL).Rows()
-		if err != nil {
-			logrus.Warning(err)
-		}
-		defer rows.Close()
-		cols, _ := rows.Columns()
-		rawResult := make([][]byte, len(cols))
-		result := make([]interface{}, len(cols))
-		dest := make([]interface{}, len(cols))
-		for i, _ := range rawResult {
-			dest[i] = &rawResult[i] // Put pointers to each string in the interface slice
-		}
-		var something []interface{}
-		for rows.Next() {
-			err = rows.Scan(dest...)
-			if err != nil {
-				logrus.Errorf("Failed to scan row %#v", err)
-				return
-			}
+	ctx, cancel := queryContext(c, body.TimeoutMs)
+	defer cancel()
+	started := time.Now()
 
-			for i, raw := range rawResult {
-				if raw == nil {
-					result[i] = "\\N"
-				} else {
-					if x, err := strconv.Atoi(string(raw)); err != nil {
-						result[i] = string(raw)
-					} else {
-						result[i] = x
-					}
-				}
+	if paginated {
+		var cursor *pageCursor
+		err = checkPagination(plan, body.PageSize)
+		if err == nil && body.Cursor != "" {
+			cursor, err = decodeCursor(body.Cursor, body.SQL)
+		}
+		if err == nil {
+			// Pages are read from each shard in turn, so the query itself
+			// is sent unchanged even when fanning out
+			shards := make([]Shard, len(targets))
+			for i, target := range targets {
+				shards[i] = target.Shard
+			}
+			if cursor != nil && replicated(plan.Tables) {
+				// The ids in the cursor only mean something on the replica
+				// it was read from, so later pages keep reading that one
+				shards = pinnedReplica(plan.Tables, cursor.Shard, shards)
 			}
-			something = append(something, result)
+			err = executePage(ctx, shards, body.SQL, plan, body.PageSize, cursor, newRowWriter(c, format))
 		}
-		c.JSON(http.StatusAccepted, gin.H{
-			"result": something,
+	} else {
+		err = executeQuery(ctx, targets, nil, plan, merge, newRowWriter(c, format))
+	}
+	respondToQuery(ctx, c, started, body.SQL, err)
+}
+
+// StructuredQuery answers a StructuredQueryBody, checking it against the
+// columns the family actually has before compiling it to SQL
+func StructuredQuery(c *gin.Context) {
+	var body StructuredQueryBody
+
+	err := c.BindJSON(&body)
+	if err != nil {
+		logrus.WithError(err).Errorf("The request did not contain a correctly formatted JSON body")
+		return
+	}
+	if !validIdentifier(body.Family) {
+		c.JSON(http.StatusBadRequest, map[string]string{
+			"message": fmt.Sprintf("%q is not a valid family name", body.Family),
 		})
 		return
 	}
-	c.JSON(http.StatusNotFound, map[string]string{
-		"message": "Sorry wasn't able to locate a family that matches requested",
-	})
+	// Groups and aggregates computed on each shard can't simply be
+	// concatenated, so they are only answered from a single shard
+	grouped := len(body.GroupBy) > 0 || len(body.Aggregates) > 0
+	if body.FanOut && grouped {
+		c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "group_by and aggregates can't be combined with fan_out",
+		})
+		return
+	}
+
+	format, err := negotiateFormat(c, body.Format)
+	if err != nil {
+		c.JSON(http.StatusNotAcceptable, map[string]string{
+			"message": err.Error(),
+		})
+		return
+	}
+
+	var from, to *time.Time
+	if body.TimeRange != nil {
+		from, to = body.TimeRange.bounds()
+	}
+	targets, merge, status, err := routeQuery([]string{body.Family}, body.FanOut, from, to)
+	if err != nil {
+		c.JSON(status, map[string]string{
+			"message": err.Error(),
+		})
+		return
+	}
+	if grouped && merge {
+		c.JSON(http.StatusBadRequest, map[string]string{
+			"message": fmt.Sprintf("group_by and aggregates aren't supported on the partitioned %s family", body.Family),
+		})
+		return
+	}
+
+	columns, err := familyColumns(targets)
+	if err != nil {
+		logrus.WithError(err).Errorf("Could not look up the columns of the %s log family", body.Family)
+		c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": err.Error(),
+		})
+		return
+	}
+	query, args, fieldErrors := compileStructuredQuery(body, columns)
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": fmt.Sprintf("The query for the %s log family is invalid", body.Family),
+			"errors":  fieldErrors,
+		})
+		return
+	}
+	plan, err := planQuery(query)
+	if err != nil {
+		logrus.WithError(err).WithField("sql", query).Error("Could not plan a compiled structured query")
+		c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": err.Error(),
+		})
+		return
+	}
+
+	ctx, cancel := queryContext(c, body.TimeoutMs)
+	defer cancel()
+	started := time.Now()
+
+	err = targetQueries(targets, query, plan, merge)
+	if err != nil {
+		logrus.WithError(err).WithField("sql", query).Error("Could not plan a compiled structured query")
+		c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": err.Error(),
+		})
+		return
+	}
+	err = executeQuery(ctx, targets, args, plan, merge, newRowWriter(c, format))
+	respondToQuery(ctx, c, started, query, err)
+}
+
+// queryContext bounds a query by the timeout the client asked for, or the
+// server default, capped at the server maximum
+func queryContext(c *gin.Context, timeoutMs int) (context.Context, context.CancelFunc) {
+	limits := currentSettings()
+	timeout := limits.QueryTimeout
+	if timeoutMs > 0 {
+		timeout = time.Duration(timeoutMs) * time.Millisecond
+	}
+	if timeout > limits.MaxQueryTimeout {
+		timeout = limits.MaxQueryTimeout
+	}
+	// The request context is cancelled when the client goes away, which
+	// kills the query just like the timeout does
+	return context.WithTimeout(c.Request.Context(), timeout)
+}
+
+// respondToQuery responds to a query that failed before its results started
+// streaming, and logs the queries that timed out or lost their client
+func respondToQuery(ctx context.Context, c *gin.Context, started time.Time, query string, err error) {
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		elapsed := time.Since(started)
+		logrus.WithField("sql", query).Warningf("A query timed out after %s", elapsed)
+		if err != nil {
+			c.JSON(http.StatusGatewayTimeout, gin.H{
+				"message":    fmt.Sprintf("The query timed out after %s", elapsed),
+				"elapsed_ms": int64(elapsed / time.Millisecond),
+			})
+		}
+	case ctx.Err() == context.Canceled:
+		logrus.WithField("sql", query).Info("The client went away before its query finished")
+	case missingTable(err):
+		logrus.WithError(err).Warning("A query ran into a family that is being moved")
+		c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"message": "A family of the query is being moved to another shard, try again",
+		})
+	case err != nil:
+		logrus.WithError(err).Warning("Could not run the query")
+		c.JSON(http.StatusBadRequest, map[string]string{
+			"message": err.Error(),
+		})
+	}
 }
 
 func loadDB() {
-	databasesNames := strings.Split(fmt.Sprintf("%s", *dbName), ",")
-	databasesAddress := strings.Split(fmt.Sprintf("%s", *dbAddress), ",")
-	// Using data from command-line parameters, we create a MySQL connection
-	// string
-
-	for _, address := range databasesAddress {
-		for _, val := range databasesNames {
-			connectionString := fmt.Sprintf(
-				"%s:%s@(%s)/%s?charset=utf8&parseTime=True&loc=Local",
-				*dbUsername,
-				*dbPassword,
-				address,
-				val,
-			)
-			shard := Shard{}
-			db, err := gorm.Open("mysql", connectionString)
-			if err != nil {
-				logrus.WithError(err).Warning("Could not establish a connection to the databases")
-				continue
-			}
-			shard.DB = db
-			shard.Families = set.New()
-			shard.status = true //Because there's not sane way to compare initialize and un-initialized structs
-			logrus.Infof("Connected to MySQL as %s at %s", *dbUsername, *dbAddress)
-			databases = append(databases, shard)
+	topology, err := loadTopology()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid shard topology")
+	}
+
+	var shardIDs []string
+	for _, config := range topology {
+		shardIDs = append(shardIDs, config.ID)
+		shard, err := connectShard(config)
+		if err != nil {
+			logrus.WithError(err).Warningf("Could not establish a connection to %s, the health checker will keep trying", config.ID)
+			unreachable = append(unreachable, pendingShard{
+				ID:     config.ID,
+				Config: config,
+				Health: newShardHealth(shardDown),
+			})
+			continue
 		}
+		databases = append(databases, shard)
 	}
 
 	if len(databases) == 0 {
 		logrus.Fatal("Could not establish a connection to any of the databases you configured")
 
 	}
+	configured := set.New()
+	for _, id := range shardIDs {
+		configured.Add(id)
+	}
+	for id := range *shardWeights {
+		if !configured.Has(id) {
+			logrus.Warningf("A weight was given for %s, which is not a configured shard", id)
+		}
+	}
+	for id := range *shardCapacities {
+		if !configured.Has(id) {
+			logrus.Warningf("A capacity was given for %s, which is not a configured shard", id)
+		}
+	}
+
+	// The ring covers every configured shard, connected or not, so that
+	// instances agree on placement regardless of which shards they reach
+	configureShards(shardIDs)
 
-	//clean update content
 	for _, shard := range databases {
-		for _, table := range databaseTables {
-			shard.DB.DropTableIfExists(table)
-			shard.DB.CreateTable(table)
+		err := prepareSchema(shard)
+		if err != nil {
+			logrus.WithError(err).Fatalf("Could not bring the schema of %s up to date", shard.ID)
 		}
 	}
+
+	loadCatalog()
 }
 
-func findExisting() {
-	for _, shard := range databases {
-		rows, _ := shard.DB.Raw("show tables").Rows()
-		for rows.Next() {
-			val := ""
-			rows.Scan(&val)
-			shard.Families.Add(val)
+// connectShard opens the connections to a shard of the topology, whose
+// defaults must have been filled in
+func connectShard(config ShardConfig) (Shard, error) {
+	shard := Shard{ID: config.ID, Tags: config.Tags}
+	weight, capacity, err := shardSizing(config)
+	if err != nil {
+		return shard, err
+	}
+	shard.Weight, shard.Capacity = weight, capacity
+
+	db, err := gorm.Open("mysql", config.dsn(config.Username, config.Password))
+	if err != nil {
+		return shard, err
+	}
+	shard.DB = db
+	if config.ReadUsername != "" {
+		readDB, err := gorm.Open("mysql", config.dsn(config.ReadUsername, config.ReadPassword))
+		if err != nil {
+			logrus.WithError(err).Warning("Could not establish a read-only connection to the databases")
+			db.Close()
+			return shard, err
 		}
+		shard.ReadDB = readDB
 	}
+	shard.Families = set.New()
+	shard.Health = newShardHealth(shardUp)
+	logrus.Infof("Connected to MySQL as %s at %s", config.Username, shard.ID)
+	return shard, nil
 }
 
 //Purge data that's a week old
 func PurgeOld() {
+	var last time.Time
 	for {
-		t := time.Now().AddDate(0, 0, -7).Format("2016-12-10 00:26:05")
-		for _, shard := range databases {
-			for _, table := range shard.Families.List() {
-				shard.DB.Exec(fmt.Sprintf("DELETE FROM %s WHERE time < %s", table.(string), t))
+		// Purging can be turned on and off by reloading --config, so this
+		// checks every minute whether a daily purge is due
+		current := currentSettings()
+		if current.Purge && time.Since(last) >= time.Hour*24 {
+			for _, shard := range liveShards() {
+				for _, placement := range catalogOf(shard.ID) {
+					family := placement.Family
+					if placement.Parent != "" {
+						family = placement.Parent
+					}
+					kept, ok := current.FamilyRetention[family]
+					if !ok {
+						kept = current.Retention
+					}
+					shard.DB.Exec(fmt.Sprintf("DELETE FROM %s WHERE time < ?", quoteIdentifier(placement.Family)), time.Now().Add(-kept))
+				}
 			}
+			last = time.Now()
 		}
-		//This will only run once daily
-		time.Sleep(time.Hour * 24)
+		time.Sleep(time.Minute)
 	}
 }
 
@@ -359,42 +1135,117 @@ func PurgeOptions(c *gin.Context) {
 		logrus.WithError(err).Errorf("The request did not contain a correctly formatted JSON body")
 		return
 	}
-	findExisting()
-	for _, shard := range databases {
-		for _, name := range shard.Families.List() {
-			if strings.TrimSpace(body.Family) == strings.TrimSpace(name.(string)) {
-				builtTime := "STR_TO_DATE('" + body.Date + "', '%d/%m/%Y %H:%i:%s')"
-				output := fmt.Sprintf("DELETE FROM %s WHERE time < %s", body.Family, builtTime)
-				shard.DB.Exec(output)
-				c.JSON(http.StatusAccepted, gin.H{
-					"message": fmt.Sprintf("All data in family %s was deleted up to %s", body.Family, body.Date),
-				})
-				return
-			}
+	family := strings.TrimSpace(body.Family)
+
+	// Every replica has to be purged, or their copies of the family would
+	// differ from then on, and a partitioned family is purged across all of
+	// its buckets
+	var placements []FamilyPlacement
+	if partitionOf(family) != "" {
+		placements = bucketsOf(family)
+	} else {
+		placements = placementsOf(family)
+	}
+	if len(placements) == 0 {
+		c.JSON(http.StatusNotFound, map[string]string{
+			"message": "Sorry wasn't able to locate a family that matches requested",
+		})
+		return
+	}
+	shards := make([]Shard, len(placements))
+	for i, placement := range placements {
+		shard, ok := shardByID(placement.ShardID)
+		if !ok || shard.down() {
+			c.JSON(http.StatusServiceUnavailable, map[string]string{
+				"message": fmt.Sprintf("%s holds the %s family and is not reachable, so nothing was purged", placement.ShardID, family),
+			})
+			return
 		}
+		shards[i] = shard
 	}
 
+	for i, placement := range placements {
+		err = shards[i].DB.Exec(
+			fmt.Sprintf("DELETE FROM %s WHERE time < STR_TO_DATE(?, '%%d/%%m/%%Y %%H:%%i:%%s')", quoteIdentifier(placement.Family)),
+			body.Date,
+		).Error
+		if err != nil {
+			logrus.WithError(err).Errorf("Could not purge the %s table on %s", placement.Family, placement.ShardID)
+			c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Database error",
+			})
+			return
+		}
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": fmt.Sprintf("All data in family %s was deleted up to %s", family, body.Date),
+	})
 }
 
 func main() {
 	// Key variables are set as command-line flags
-	_, err := cli.Parse(os.Args[1:])
+	command, err := cli.Parse(os.Args[1:])
 
 	if err != nil {
 		logrus.WithError(err).Fatal("Error parsing command-line arguments")
 	}
 
-	if *debug {
-		// Enable debug logging
-		logrus.SetLevel(logrus.DebugLevel)
+	userFlags, err = flagsSetByUser(os.Args[1:])
+	if err != nil {
+		logrus.WithError(err).Fatal("Error parsing command-line arguments")
+	}
+	loadedConfig, err = loadConfig()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid configuration file")
+	}
+	resolved, err := resolveSettings(loadedConfig)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid configuration")
+	}
+	// Logging, including debug mode, is set up by applySettings
+	applySettings(resolved)
+
+	if *replicationFactor < 1 {
+		logrus.Fatal("The replication factor must be at least 1")
+	}
+
+	if *placementVnodes < 1 {
+		logrus.Fatal("Every shard needs at least 1 virtual node on the hash ring")
+	}
+
+	if *healthFall < 1 || *healthRise < 1 {
+		logrus.Fatal("A shard has to fail or pass at least 1 health check to change state")
+	}
+
+	if *rebalanceMaxMoves < 1 || *rebalanceConcurrency < 1 {
+		logrus.Fatal("The rebalancer needs to be allowed at least 1 move at a time")
+	}
+
+	switch command {
+	case migrateCommand.FullCommand():
+		runMigrateCommand()
+		return
+	case wipeCommand.FullCommand():
+		runWipeRawLogsCommand()
+		return
 	}
 
 	//Databases access
 	loadDB()
+	go healthLoop()
+	go catalogLoop()
+	go hintLoop()
 
-	if *purge {
-		//Non blocking situation here, throw into its own goroutine
-		go PurgeOld()
+	//Non blocking situation here, throw into its own goroutine
+	go PurgeOld()
+
+	if *configFile != "" {
+		go watchConfig()
+	}
+
+	if *rebalance {
+		rebalancer.status.Enabled = true
+		go rebalanceLoop()
 	}
 
 	logrus.Infof("Starting HTTP server on %s", *serverAddress)
@@ -404,9 +1255,29 @@ func main() {
 	// micro-service
 	r := gin.New()
 
-	r.PUT("/api/log", IngestLog)
-	r.PUT("/api/query", QueryMagic)
-	r.PUT("/api/purge", PurgeOptions)
+	api := r.Group("/api", requireToken(false))
+	admin := r.Group("/api/admin", requireToken(true))
+
+	api.PUT("/log", IngestLog)
+	api.PUT("/query", QueryMagic)
+	api.PUT("/query/structured", StructuredQuery)
+	api.PUT("/purge", PurgeOptions)
+
+	admin.GET("/families", ListFamilies)
+	admin.GET("/families/:family", ShowFamily)
+	admin.PUT("/families/:family/migrate", requireAdminTokens(), MigrateFamily)
+	admin.GET("/migrations", ListMigrations)
+	admin.GET("/migrations/:family", ShowMigration)
+	admin.GET("/shards", ListShards)
+	admin.PUT("/shards", requireAdminTokens(), RegisterShard)
+	admin.GET("/shards/drain", ListDrains)
+	admin.PUT("/shards/drain", requireAdminTokens(), DrainShard)
+	admin.PUT("/shards/decommission", requireAdminTokens(), DecommissionShard)
+	admin.GET("/health", ShowHealth)
+	admin.GET("/schema", ShowSchema)
+	admin.GET("/rebalance", ShowRebalance)
+	admin.GET("/rebalance/plan", PlanRebalance)
+	admin.PUT("/rebalance", requireAdminTokens(), StartRebalance)
 
 	r.Run(*serverAddress)
 }
@@ -0,0 +1,816 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// The states a family migration goes through
+const (
+	migrationCopying   = "copying"
+	migrationVerifying = "verifying"
+	// migrationFinishing is the state of a migration that has switched the
+	// catalog over and waits for every instance to notice before dropping
+	// the source
+	migrationFinishing = "finishing"
+	migrationDone      = "done"
+	migrationFailed    = "failed"
+)
+
+// defaultMigrationBatch is the number of rows copied at a time when the
+// request doesn't say
+const defaultMigrationBatch = 1000
+
+// MigrateBody is the format of the JSON required in the body of a request to
+// the MigrateFamily handler
+type MigrateBody struct {
+	// Target is the ID of the shard to move the family to
+	Target string `json:"target" binding:"required"`
+	// Source is the ID of the shard to move the family off, which only has
+	// to be given for a family on several shards
+	Source    string `json:"source"`
+	BatchSize int    `json:"batch_size"`
+	// ThrottleMs is how long to wait between batches, to go easy on the
+	// shards
+	ThrottleMs int `json:"throttle_ms"`
+}
+
+// migrationOptions tune how a family migration copies the family
+type migrationOptions struct {
+	BatchSize int
+	Throttle  time.Duration
+	// Hold, when set, is asked before every batch and pauses the copy for
+	// as long as it gives a reason to
+	Hold func() string
+}
+
+// migrationStatus is the progress of a family migration as shown by the
+// admin API
+type migrationStatus struct {
+	Family     string `json:"family"`
+	Source     string `json:"source"`
+	Target     string `json:"target"`
+	BatchSize  int    `json:"batch_size"`
+	ThrottleMs int64  `json:"throttle_ms"`
+	State      string `json:"state"`
+	// Held says why the copy is paused, if it is
+	Held string `json:"held,omitempty"`
+	// Rows and RawLogs are how many rows there were to copy once writes
+	// started being mirrored, while the copied counts also include rows
+	// mirrored before the copy got to them
+	Rows          int64      `json:"rows"`
+	CopiedRows    int64      `json:"copied_rows"`
+	RawLogs       int64      `json:"raw_logs"`
+	CopiedRawLogs int64      `json:"copied_raw_logs"`
+	Started       time.Time  `json:"started"`
+	Finished      *time.Time `json:"finished,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// familyMigration moves a family from one shard to another while it keeps
+// being ingested, through this instance or any other. The family is created
+// on the target and cataloged there as incoming, then marked migrating on the
+// source, from when on every write to the source is mirrored to the target
+// with the same ids. The rows from before are copied in batches. Once both
+// shards hold the same rows the catalog is switched over to the target, and
+// the source is dropped. The catalog row of the family on the source keeps
+// this in step with the writes of every instance, which hold it while they
+// write, see checkPlacement, and which find out about each change of it
+// there.
+type familyMigration struct {
+	mu      sync.Mutex
+	status  migrationStatus
+	options migrationOptions
+	// createdTarget is set once the family table exists on the target and
+	// has to be dropped if the migration fails
+	createdTarget bool
+	// recordedTarget is set once the target is cataloged as incoming
+	recordedTarget bool
+	// mirroring is set once the source is marked migrating, and has to be
+	// marked active again if the migration fails
+	mirroring bool
+}
+
+// migrations holds the latest migration of every family, keyed by family
+var (
+	migrations     = map[string]*familyMigration{}
+	migrationsLock sync.Mutex
+)
+
+// familyLocks are taken for reading by every ingest request while it writes
+// to a family, and for writing by the request creating the family
+var (
+	familyLocks     = map[string]*sync.RWMutex{}
+	familyLocksLock sync.Mutex
+)
+
+// familyLock returns the lock of a family
+func familyLock(family string) *sync.RWMutex {
+	familyLocksLock.Lock()
+	defer familyLocksLock.Unlock()
+
+	lock, ok := familyLocks[family]
+	if !ok {
+		lock = &sync.RWMutex{}
+		familyLocks[family] = lock
+	}
+	return lock
+}
+
+// startMigration checks that a family can be moved from the source shard to
+// the target and starts moving it in the background. The source may be left
+// empty for a family on a single shard. The returned status code goes with
+// the error when it can't.
+func startMigration(family string, sourceID string, targetID string, options migrationOptions) (*familyMigration, int, error) {
+	placements := placementsOf(family)
+	if len(placements) == 0 {
+		return nil, http.StatusNotFound, fmt.Errorf("the %s family is not in the placement catalog", family)
+	}
+	if sourceID == "" && len(placements) > 1 {
+		return nil, http.StatusConflict, fmt.Errorf("the %s family is placed on more than one shard, so the source has to be given", family)
+	}
+	var placement FamilyPlacement
+	found := false
+	for _, candidate := range placements {
+		if sourceID == "" || candidate.ShardID == sourceID {
+			placement, found = candidate, true
+			break
+		}
+	}
+	if !found {
+		return nil, http.StatusNotFound, fmt.Errorf("the %s family is not on %s", family, sourceID)
+	}
+	source, ok := shardByID(placement.ShardID)
+	if !ok || source.down() {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("the shard %s holding the %s family is down", placement.ShardID, family)
+	}
+	target, ok := shardByID(targetID)
+	if !ok {
+		return nil, http.StatusBadRequest, fmt.Errorf("%s is not a connected shard", targetID)
+	}
+	if target.down() {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("%s is down", targetID)
+	}
+	if placedOn(family, target.ID) {
+		return nil, http.StatusBadRequest, fmt.Errorf("the %s family is already on %s", family, target.ID)
+	}
+	for _, other := range placements {
+		// Which may be another instance migrating it
+		if other.Status != placementActive {
+			return nil, http.StatusConflict, fmt.Errorf("the %s family is already being migrated", family)
+		}
+	}
+	load, err := measureShard(target)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("could not measure %s: %s", target.ID, err)
+	}
+	if load.Full {
+		return nil, http.StatusConflict, fmt.Errorf("%s is above the high-water mark", target.ID)
+	}
+
+	migrationsLock.Lock()
+	defer migrationsLock.Unlock()
+	if existing, ok := migrations[family]; ok {
+		state := existing.snapshot().State
+		if state != migrationDone && state != migrationFailed {
+			return nil, http.StatusConflict, fmt.Errorf("the %s family is already being migrated", family)
+		}
+	}
+
+	migration := &familyMigration{
+		status: migrationStatus{
+			Family:     family,
+			Source:     source.ID,
+			Target:     target.ID,
+			BatchSize:  options.BatchSize,
+			ThrottleMs: int64(options.Throttle / time.Millisecond),
+			State:      migrationCopying,
+			Started:    time.Now(),
+		},
+		options: options,
+	}
+	migrations[family] = migration
+	go migration.run(source, target, placement)
+
+	return migration, http.StatusAccepted, nil
+}
+
+// snapshot returns a copy of the progress of the migration
+func (m *familyMigration) snapshot() migrationStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// wait blocks until the migration is done or has failed
+func (m *familyMigration) wait() migrationStatus {
+	for {
+		status := m.snapshot()
+		if status.State == migrationDone || status.State == migrationFailed {
+			return status
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// update changes the progress of the migration
+func (m *familyMigration) update(change func(status *migrationStatus)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	change(&m.status)
+}
+
+// pace is called before every batch copied while the family is still on the
+// source. It waits out the throttle and any hold on the migration.
+func (m *familyMigration) pace() {
+	time.Sleep(m.options.Throttle)
+	for m.options.Hold != nil {
+		reason := m.options.Hold()
+		m.update(func(status *migrationStatus) {
+			status.Held = reason
+		})
+		if reason == "" {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// run carries out the migration and cleans up after it when it fails
+func (m *familyMigration) run(source Shard, target Shard, placement FamilyPlacement) {
+	status := m.snapshot()
+	logrus.Infof("Migrating the %s family from %s to %s", status.Family, source.ID, target.ID)
+
+	err := m.migrate(source, target, placement)
+	if err != nil {
+		logrus.WithError(err).Errorf("Could not migrate the %s family from %s to %s", status.Family, source.ID, target.ID)
+		m.abort(source, target)
+	}
+
+	now := time.Now()
+	m.update(func(status *migrationStatus) {
+		status.Finished = &now
+		if err != nil {
+			status.State = migrationFailed
+			status.Error = err.Error()
+		} else {
+			status.State = migrationDone
+		}
+	})
+}
+
+// migrate copies the family, hands it over to the target and drops the source
+func (m *familyMigration) migrate(source Shard, target Shard, placement FamilyPlacement) error {
+	family := placement.Family
+	quoted := quoteIdentifier(family)
+	rawLogTable := source.DB.NewScope(&RawLog{}).TableName()
+
+	var name, definition string
+	err := source.DB.Raw("SHOW CREATE TABLE "+quoted).Row().Scan(&name, &definition)
+	if err != nil {
+		return err
+	}
+	err = target.DB.Exec(definition).Error
+	if err != nil {
+		return err
+	}
+	m.createdTarget = true
+
+	var schema map[string]string
+	err = json.Unmarshal([]byte(placement.Schema), &schema)
+	if err != nil {
+		return err
+	}
+	incoming := placement
+	incoming.Status = placementIncoming
+	err = recordPlacement(target, incoming, schema)
+	if err != nil {
+		return err
+	}
+	m.recordedTarget = true
+
+	rawCutoff, err := m.startMirroring(source, family)
+	if err != nil {
+		return err
+	}
+
+	var rows, rawLogs int64
+	err = source.DB.Raw("SELECT COUNT(*) FROM " + quoted).Row().Scan(&rows)
+	if err == nil {
+		err = source.DB.Raw("SELECT COUNT(*) FROM "+quoteIdentifier(rawLogTable)+" WHERE family = ? AND id <= ?", family, rawCutoff).Row().Scan(&rawLogs)
+	}
+	if err != nil {
+		return err
+	}
+	m.update(func(status *migrationStatus) {
+		status.Rows = rows
+		status.RawLogs = rawLogs
+	})
+
+	// Every write from before the mirroring started has committed by now and
+	// every later one is mirrored, so a single pass copies the rest
+	err = m.copyRows(source, target)
+	if err != nil {
+		return err
+	}
+	err = m.copyRawLogs(source, target, rawCutoff)
+	if err != nil {
+		return err
+	}
+
+	m.update(func(status *migrationStatus) {
+		status.State = migrationVerifying
+	})
+	err = m.handOver(source, target, placement)
+	if err != nil {
+		return err
+	}
+
+	// Instances that haven't read the catalog since the switch may still
+	// query the source, so it is only dropped once they all have. Failing
+	// to drop it only leaves some garbage behind.
+	m.update(func(status *migrationStatus) {
+		status.State = migrationFinishing
+	})
+	time.Sleep(*catalogRefresh)
+	err = source.DB.Exec("DROP TABLE " + quoted).Error
+	if err != nil {
+		logrus.WithError(err).Warningf("Could not drop the migrated %s family from %s", family, source.ID)
+	}
+	err = deleteRawLogs(source, family, m.options.BatchSize)
+	if err != nil {
+		logrus.WithError(err).Warningf("Could not delete the raw logs of the migrated %s family from %s", family, source.ID)
+	}
+
+	logrus.Infof("Migrated the %s family from %s to %s", family, source.ID, target.ID)
+	return nil
+}
+
+// startMirroring marks the family migrating on the source, which makes every
+// later write to it mirror its rows to the target, and returns the id of the
+// last raw log of the family written before. The update of the catalog row
+// waits for the writes holding it, so every raw log up to that id has been
+// committed and every one after it is mirrored.
+func (m *familyMigration) startMirroring(source Shard, family string) (int64, error) {
+	tx := source.DB.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	var cutoff int64
+	update := tx.Model(&FamilyPlacement{}).
+		Where("family = ? AND shard_id = ?", family, source.ID).
+		Update("status", placementMigrating)
+	err := update.Error
+	if err == nil && update.RowsAffected != 1 {
+		err = fmt.Errorf("the %s family is not cataloged on %s", family, source.ID)
+	}
+	if err == nil {
+		rawLogTable := tx.NewScope(&RawLog{}).TableName()
+		err = tx.Raw("SELECT COALESCE(MAX(id), 0) FROM "+quoteIdentifier(rawLogTable)+" WHERE family = ?", family).Row().Scan(&cutoff)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return 0, err
+	}
+
+	m.mirroring = true
+	cachePlacementStatus(source.ID, family, placementMigrating)
+	return cutoff, nil
+}
+
+// copyRows copies the rows of the family from the source to the target with
+// their ids, leaving alone those the mirroring already wrote there
+func (m *familyMigration) copyRows(source Shard, target Shard) error {
+	family := m.snapshot().Family
+	_, err := copyBatches(source.DB, "SELECT * FROM "+quoteIdentifier(family)+" WHERE id > ? ORDER BY id LIMIT ?", nil, 0, m.options.BatchSize,
+		func(columns []string, batch [][]interface{}) error {
+			m.pace()
+			err := insertMissingRows(target.DB, family, columns, batch, currentSettings().InsertChunkSize)
+			if err == nil {
+				m.update(func(status *migrationStatus) {
+					status.CopiedRows += int64(len(batch))
+				})
+			}
+			return err
+		},
+	)
+	return err
+}
+
+// copyRawLogs copies the raw logs of the family up to the id cutoff from the
+// source to the target, the later ones being mirrored. The raw logs table of
+// the target has ids of its own, so only the contents of the rows are copied.
+func (m *familyMigration) copyRawLogs(source Shard, target Shard, cutoff int64) error {
+	family := m.snapshot().Family
+	rawLogTable := source.DB.NewScope(&RawLog{}).TableName()
+	_, err := copyBatches(source.DB, "SELECT id, family, log FROM "+quoteIdentifier(rawLogTable)+" WHERE family = ? AND id <= ? AND id > ? ORDER BY id LIMIT ?", []interface{}{family, cutoff}, 0, m.options.BatchSize,
+		func(columns []string, batch [][]interface{}) error {
+			m.pace()
+			rawRows := make([][]interface{}, len(batch))
+			for i, row := range batch {
+				rawRows[i] = row[1:]
+			}
+			err := insertRows(target.DB, rawLogTable, columns[1:], rawRows, currentSettings().InsertChunkSize)
+			if err == nil {
+				m.update(func(status *migrationStatus) {
+					status.CopiedRawLogs += int64(len(batch))
+				})
+			}
+			return err
+		},
+	)
+	return err
+}
+
+// familyMark is how far the rows and raw logs of a family went on both shards
+// of a migration at a moment when no write to the family was in flight. Row
+// ids are the same on both shards, raw log ids aren't.
+type familyMark struct {
+	ID          int64
+	SourceRawID int64
+	TargetRawID int64
+}
+
+// handOver checks that the target holds the same rows and raw logs as the
+// source and switches the catalog over to it. Most of the comparison runs
+// without holding anything, up to a mark taken while no write to the family
+// was in flight. Only what came in since is compared while the catalog rows
+// are locked, which holds up writes to the family for that long, and the
+// writes that waited then find the family on the target.
+func (m *familyMigration) handOver(source Shard, target Shard, placement FamilyPlacement) error {
+	family := placement.Family
+	existing, err := tableColumns(source.DB, family)
+	if err != nil {
+		return err
+	}
+	columns := make([]string, 0, len(existing))
+	for column := range existing {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	mark, err := markFamily(source, target, family)
+	if err != nil {
+		return err
+	}
+	err = compareFamily(source, target, family, columns, mark, false)
+	if err != nil {
+		return err
+	}
+
+	// Writes to the target itself check its catalog row, so it is locked as
+	// well until the source has let go of the family
+	sourceTx := source.DB.Begin()
+	if sourceTx.Error != nil {
+		return sourceTx.Error
+	}
+	targetTx := target.DB.Begin()
+	if targetTx.Error != nil {
+		sourceTx.Rollback()
+		return targetTx.Error
+	}
+	err = lockPlacement(sourceTx, source.ID, family)
+	if err == nil {
+		err = lockPlacement(targetTx, target.ID, family)
+	}
+	if err == nil {
+		err = compareFamily(source, target, family, columns, mark, true)
+	}
+	if err == nil {
+		err = targetTx.Model(&FamilyPlacement{}).
+			Where("family = ? AND shard_id = ?", family, target.ID).
+			Update("status", placementActive).Error
+	}
+	if err == nil {
+		err = sourceTx.Where("family = ? AND shard_id = ?", family, source.ID).Delete(&FamilyPlacement{}).Error
+	}
+	if err == nil {
+		err = sourceTx.Commit().Error
+	}
+	if err != nil {
+		sourceTx.Rollback()
+		targetTx.Rollback()
+		return err
+	}
+	uncachePlacement(source, family)
+
+	err = targetTx.Commit().Error
+	if err != nil {
+		// The family is off the source already, so the only way forward is
+		// marking it active on the target once more
+		err = setPlacementStatus(target, family, placementActive)
+		if err != nil {
+			return fmt.Errorf("the %s family is now only cataloged as incoming on %s, and has to be marked active there by hand: %s", family, target.ID, err)
+		}
+	}
+	cachePlacementStatus(target.ID, family, placementActive)
+	return nil
+}
+
+// markFamily takes the mark up to which a migration compares a family before
+// it locks the catalog rows. The catalog row of the source is locked while
+// the mark is taken, which waits for the writes in flight, along with what
+// they mirror to the target.
+func markFamily(source Shard, target Shard, family string) (familyMark, error) {
+	var mark familyMark
+	rawLogTable := quoteIdentifier(source.DB.NewScope(&RawLog{}).TableName())
+
+	tx := source.DB.Begin()
+	if tx.Error != nil {
+		return mark, tx.Error
+	}
+	defer tx.Rollback()
+	err := lockPlacement(tx, source.ID, family)
+	if err == nil {
+		err = tx.Raw("SELECT COALESCE(MAX(id), 0) FROM " + quoteIdentifier(family)).Row().Scan(&mark.ID)
+	}
+	if err == nil {
+		err = tx.Raw("SELECT COALESCE(MAX(id), 0) FROM "+rawLogTable+" WHERE family = ?", family).Row().Scan(&mark.SourceRawID)
+	}
+	if err == nil {
+		err = target.DB.Raw("SELECT COALESCE(MAX(id), 0) FROM "+rawLogTable+" WHERE family = ?", family).Row().Scan(&mark.TargetRawID)
+	}
+	return mark, err
+}
+
+// lockPlacement locks the catalog row of a family on the shard tx runs on,
+// which holds up the writes to the family there until tx ends
+func lockPlacement(tx *gorm.DB, shardID string, family string) error {
+	table := tx.NewScope(&FamilyPlacement{}).TableName()
+	var status sql.NullString
+	err := tx.Raw(
+		"SELECT status FROM "+quoteIdentifier(table)+" WHERE family = ? LIMIT 1 FOR UPDATE",
+		family,
+	).Row().Scan(&status)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("the %s family is no longer cataloged on %s", family, shardID)
+	}
+	return err
+}
+
+// compareFamily compares the rows and raw logs of the family on the source
+// and the target of a migration up to the mark, or after it
+func compareFamily(source Shard, target Shard, family string, columns []string, mark familyMark, afterMark bool) error {
+	rows := idRange{After: 0, Through: mark.ID}
+	sourceRaw := idRange{After: 0, Through: mark.SourceRawID}
+	targetRaw := idRange{After: 0, Through: mark.TargetRawID}
+	if afterMark {
+		rows = idRange{After: mark.ID, Through: math.MaxInt64}
+		sourceRaw = idRange{After: mark.SourceRawID, Through: math.MaxInt64}
+		targetRaw = idRange{After: mark.TargetRawID, Through: math.MaxInt64}
+	}
+
+	sourceSum, err := familyChecksum(source, family, columns, rows, sourceRaw)
+	if err != nil {
+		return err
+	}
+	targetSum, err := familyChecksum(target, family, columns, rows, targetRaw)
+	if err != nil {
+		return err
+	}
+	if sourceSum != targetSum {
+		return fmt.Errorf("the family on the target doesn't match the source: %s against %s", targetSum, sourceSum)
+	}
+	return nil
+}
+
+// abort undoes what a failed migration did to the target and puts the family
+// back to normal on the source
+func (m *familyMigration) abort(source Shard, target Shard) {
+	family := m.snapshot().Family
+
+	if !placedOn(family, source.ID) {
+		// The catalog was switched over, so the target holds the family now
+		logrus.Errorf("The %s family was switched over to %s, so it is left there", family, target.ID)
+		return
+	}
+
+	// Marking the source active again waits for the writes mirroring to the
+	// target, and stops later ones from doing so
+	if m.mirroring {
+		err := setPlacementStatus(source, family, placementActive)
+		if err != nil {
+			logrus.WithError(err).Warningf("Could not mark the %s family on %s active again", family, source.ID)
+		}
+	}
+
+	if m.recordedTarget {
+		err := removePlacement(target, family)
+		if err != nil {
+			logrus.WithError(err).Warningf("Could not remove the partial copy of the %s family on %s from the catalog", family, target.ID)
+		}
+	}
+
+	if m.createdTarget {
+		err := target.DB.Exec("DROP TABLE IF EXISTS " + quoteIdentifier(family)).Error
+		if err != nil {
+			logrus.WithError(err).Warningf("Could not drop the partial copy of the %s family from %s", family, target.ID)
+		}
+		err = deleteRawLogs(target, family, m.options.BatchSize)
+		if err != nil {
+			logrus.WithError(err).Warningf("Could not delete the copied raw logs of the %s family from %s", family, target.ID)
+		}
+	}
+}
+
+// copyBatches reads the rows of query with ids above after batch by batch,
+// hands them to write and returns the last id read. The query must select the
+// id first and order by it, and takes args followed by the last id read and
+// the batch size.
+func copyBatches(db *gorm.DB, query string, args []interface{}, after int64, batchSize int, write func(columns []string, batch [][]interface{}) error) (int64, error) {
+	for {
+		batchArgs := append(append([]interface{}{}, args...), after, batchSize)
+		rows, err := db.Raw(query, batchArgs...).Rows()
+		if err != nil {
+			return after, err
+		}
+		columns, batch, err := scanBatch(rows)
+		rows.Close()
+		if err != nil {
+			return after, err
+		}
+		if len(batch) == 0 {
+			return after, nil
+		}
+
+		last, err := toInt64(batch[len(batch)-1][0])
+		if err != nil {
+			return after, err
+		}
+		err = write(columns, batch)
+		if err != nil {
+			return after, err
+		}
+		after = last
+	}
+}
+
+// scanBatch reads every row of a result. Text comes back from the driver as
+// bytes and is turned back into strings so JSON columns accept it.
+func scanBatch(rows *sql.Rows) ([]string, [][]interface{}, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var batch [][]interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, value := range values {
+			if b, ok := value.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		batch = append(batch, values)
+	}
+
+	return columns, batch, rows.Err()
+}
+
+// toInt64 reads an id as returned by the driver
+func toInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return 0, fmt.Errorf("expected an id but got %T", value)
+}
+
+// idRange narrows a checksum down to the ids above After and up to Through
+type idRange struct {
+	After   int64
+	Through int64
+}
+
+// familyChecksum summarizes the rows of a family on a shard and its raw logs
+// within the given ranges of ids: how many there are, and checksums of both
+func familyChecksum(shard Shard, family string, columns []string, rowIDs idRange, rawIDs idRange) (string, error) {
+	fields := make([]string, 0, 2*len(columns))
+	for _, column := range columns {
+		quoted := quoteIdentifier(column)
+		fields = append(fields, quoted, "ISNULL("+quoted+")")
+	}
+	rowSum := "CRC32(CONCAT_WS('#', " + strings.Join(fields, ", ") + "))"
+
+	var rows, rawLogs int64
+	var rowChecksum, rawChecksum uint64
+	err := shard.DB.Raw(
+		"SELECT COUNT(*), COALESCE(BIT_XOR("+rowSum+"), 0) FROM "+quoteIdentifier(family)+" WHERE id > ? AND id <= ?",
+		rowIDs.After, rowIDs.Through,
+	).Row().Scan(&rows, &rowChecksum)
+	if err != nil {
+		return "", err
+	}
+
+	rawLogTable := shard.DB.NewScope(&RawLog{}).TableName()
+	err = shard.DB.Raw(
+		"SELECT COUNT(*), COALESCE(BIT_XOR(CRC32(log)), 0) FROM "+quoteIdentifier(rawLogTable)+" WHERE family = ? AND id > ? AND id <= ?",
+		family, rawIDs.After, rawIDs.Through,
+	).Row().Scan(&rawLogs, &rawChecksum)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d rows (checksum %x), %d raw logs (checksum %x)", rows, rowChecksum, rawLogs, rawChecksum), nil
+}
+
+// deleteRawLogs deletes the raw logs of a family from a shard a batch at a
+// time, so a large family doesn't hold locks on the table for long
+func deleteRawLogs(shard Shard, family string, batchSize int) error {
+	rawLogTable := shard.DB.NewScope(&RawLog{}).TableName()
+	for {
+		result := shard.DB.Exec(fmt.Sprintf("DELETE FROM %s WHERE family = ? LIMIT %d", quoteIdentifier(rawLogTable), batchSize), family)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+	}
+}
+
+// MigrateFamily is the admin handler starting the migration of a family to
+// another shard
+func MigrateFamily(c *gin.Context) {
+	var body MigrateBody
+	err := c.BindJSON(&body)
+	if err != nil {
+		logrus.WithError(err).Errorf("The request did not contain a correctly formatted JSON body")
+		return
+	}
+	if body.BatchSize <= 0 {
+		body.BatchSize = defaultMigrationBatch
+	}
+
+	migration, status, err := startMigration(c.Param("family"), body.Source, body.Target, migrationOptions{
+		BatchSize: body.BatchSize,
+		Throttle:  time.Duration(body.ThrottleMs) * time.Millisecond,
+	})
+	if err != nil {
+		c.JSON(status, map[string]string{
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(status, migration.snapshot())
+}
+
+// ListMigrations is the admin handler showing the latest migration of every
+// family that has been migrated since the service started
+func ListMigrations(c *gin.Context) {
+	migrationsLock.Lock()
+	statuses := make([]migrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		statuses = append(statuses, migration.snapshot())
+	}
+	migrationsLock.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Started.Before(statuses[j].Started)
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"migrations": statuses,
+	})
+}
+
+// ShowMigration is the admin handler showing the progress of the latest
+// migration of a family
+func ShowMigration(c *gin.Context) {
+	family := c.Param("family")
+	migrationsLock.Lock()
+	migration, ok := migrations[family]
+	migrationsLock.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, map[string]string{
+			"message": fmt.Sprintf("The %s family hasn't been migrated", family),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, migration.snapshot())
+}
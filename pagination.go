@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// pageCursor is the position a paginated query continues from. Clients get
+// it as an opaque token and pass it back unchanged.
+type pageCursor struct {
+	// Query fingerprints the SQL the cursor was handed out for
+	Query uint64 `json:"q"`
+	// Shard is the ID of the shard the next page starts on
+	Shard string `json:"s"`
+	// After is the last id already returned from that shard
+	After int64 `json:"a"`
+}
+
+// queryFingerprint identifies the SQL of a paginated query so a cursor can't
+// be used to continue a different query
+func queryFingerprint(query string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(query))
+	return hash.Sum64()
+}
+
+func encodeCursor(cursor pageCursor) string {
+	encoded, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// decodeCursor decodes a cursor token and checks it belongs to query
+func decodeCursor(token string, query string) (*pageCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("the cursor is invalid")
+	}
+	var cursor pageCursor
+	err = json.Unmarshal(decoded, &cursor)
+	if err != nil {
+		return nil, fmt.Errorf("the cursor is invalid")
+	}
+	if cursor.Query != queryFingerprint(query) {
+		return nil, fmt.Errorf("the cursor belongs to a different query")
+	}
+	return &cursor, nil
+}
+
+// pinnedReplica returns the replica of a replicated family a cursor was read
+// from, or routed when it isn't reachable any more
+func pinnedReplica(tables []string, shardID string, routed []Shard) []Shard {
+	for _, shard := range shardsHolding(tables) {
+		if shard.ID == shardID && !shard.down() {
+			return []Shard{shard}
+		}
+	}
+	return routed
+}
+
+// checkPagination makes sure a query can be paginated. Pages are keyed on the
+// id primary key of a single family, which leaves no room for an ORDER BY or
+// LIMIT of the query's own.
+func checkPagination(plan queryPlan, pageSize int) error {
+	switch {
+	case pageSize < 1:
+		return fmt.Errorf("page_size must be at least 1")
+	case len(plan.Tables) != 1:
+		return fmt.Errorf("only queries over a single family can be paginated")
+	case plan.Limit >= 0 || len(plan.OrderBy) > 0:
+		return fmt.Errorf("paginated queries are ordered by id and limited by page_size, so they can't have an ORDER BY or LIMIT")
+	}
+	return nil
+}
+
+// executePage streams a single page of a paginated query to w. Shards are
+// visited in order of their ID and the rows of each are read in id order, so
+// the cursor handed out at the end always resumes exactly where the page
+// stopped, however many rows are ingested in the meantime. Errors that
+// happen before anything has been written are returned.
+func executePage(ctx context.Context, shards []Shard, query string, plan queryPlan, pageSize int, cursor *pageCursor, w rowWriter) error {
+	ordered := make([]Shard, len(shards))
+	copy(ordered, shards)
+	sort.Slice(ordered, func(a, b int) bool {
+		return ordered[a].ID < ordered[b].ID
+	})
+
+	fingerprint := queryFingerprint(query)
+	start, after := 0, int64(0)
+	if cursor != nil {
+		start = -1
+		for i, shard := range ordered {
+			if shard.ID == cursor.Shard {
+				start = i
+			}
+		}
+		if start < 0 {
+			return fmt.Errorf("the cursor points at shard %s, which no longer holds the %s family", cursor.Shard, plan.Tables[0])
+		}
+		after = cursor.After
+	}
+
+	// Cut the query off after its last token so a trailing semicolon or
+	// comment can't break out of the derived table
+	tokens := plan.Statement.Tokens
+	query = query[:tokens[len(tokens)-1].End]
+	paged := fmt.Sprintf("SELECT * FROM (%s) AS page WHERE page.id > ? ORDER BY page.id LIMIT ?", query)
+	remaining := pageSize
+	var columns []resultColumn
+	idIndex := -1
+	var end resultEnd
+
+	for i := start; i < len(ordered); i++ {
+		if remaining == 0 {
+			// The page filled up exactly as the previous shard ran out
+			end.NextCursor = encodeCursor(pageCursor{Query: fingerprint, Shard: ordered[i].ID})
+			break
+		}
+
+		// One row more than needed tells us whether the shard has more
+		shardCtx, cancel := context.WithCancel(ctx)
+		stream := make(chan shardMessage, 64)
+		go streamShard(shardCtx, ordered[i], paged, []interface{}{after, remaining + 1}, plan.Tables, stream)
+
+		message, ok := <-stream
+		if !ok || message.Err != nil {
+			cancel()
+			err := ctx.Err()
+			if ok {
+				err = message.Err
+			}
+			if columns == nil {
+				return err
+			}
+			end.Err = err
+			break
+		}
+
+		if columns == nil {
+			columns = uniqueColumnNames(message.Columns)
+			for j, column := range columns {
+				if strings.EqualFold(column.Name, "id") {
+					idIndex = j
+				}
+			}
+			if idIndex < 0 {
+				cancel()
+				return fmt.Errorf("paginated queries have to select the id column")
+			}
+			err := w.Begin(columns)
+			if err != nil {
+				cancel()
+				return nil
+			}
+		}
+
+		lastID, count := after, 0
+		for message := range stream {
+			if message.Err != nil {
+				end.Err = message.Err
+				break
+			}
+			if count == remaining {
+				// There is more on this shard than fits on the page
+				end.NextCursor = encodeCursor(pageCursor{Query: fingerprint, Shard: ordered[i].ID, After: lastID})
+				break
+			}
+
+			id, ok := message.Row[idIndex].(int64)
+			if !ok {
+				end.Err = fmt.Errorf("the id column has to be an integer to paginate")
+				break
+			}
+			lastID = id
+			count++
+			noteColumnTypes(columns, message.Row)
+			if w.Row(message.Row) != nil {
+				cancel()
+				return nil
+			}
+		}
+		cancel()
+
+		if end.Err != nil || end.NextCursor != "" {
+			break
+		}
+		remaining -= count
+		after = 0
+	}
+
+	if end.Err != nil {
+		end.Err = interruption(ctx, end.Err)
+		logrus.WithError(end.Err).Warning("A paginated query failed while streaming its results")
+		end.NextCursor = ""
+	}
+	if columns == nil {
+		return fmt.Errorf("the cursor is past the end of the results")
+	}
+	finishResult(w, columns, end)
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// The time buckets a family can be partitioned into
+const (
+	partitionDay   = "day"
+	partitionWeek  = "week"
+	partitionMonth = "month"
+)
+
+// bucketSuffixLayout formats the start of a time bucket into the name of its
+// table, as in dog_registry__20170109
+const bucketSuffixLayout = "20060102"
+
+// maxPartitionedFamilyLength leaves room in a MySQL table name for the bucket
+// suffix
+const maxPartitionedFamilyLength = 64 - len("__"+bucketSuffixLayout)
+
+// bucketMargin widens the time range of a query when picking the buckets it
+// reads, since the times it compares against are in the time zone of the
+// MySQL session rather than UTC
+const bucketMargin = 24 * time.Hour
+
+// validatePartition checks the partition option of an ingest request
+func validatePartition(body IngestLogBody) map[string]string {
+	fieldErrors := map[string]string{}
+
+	switch body.Partition {
+	case "":
+	case partitionDay, partitionWeek, partitionMonth:
+		if len(body.Family) > maxPartitionedFamilyLength {
+			fieldErrors["family"] = fmt.Sprintf("The name of a partitioned family can be at most %d characters long", maxPartitionedFamilyLength)
+		}
+	default:
+		fieldErrors["partition"] = fmt.Sprintf("%q is not a supported partition, use day, week or month", body.Partition)
+	}
+
+	return fieldErrors
+}
+
+// bucketStart returns the start of the time bucket holding t. Buckets are in
+// UTC and weeks start on Monday.
+func bucketStart(t time.Time, partition string) time.Time {
+	t = t.UTC()
+	switch partition {
+	case partitionWeek:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case partitionMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// bucketEnd returns the end of the time bucket starting at start
+func bucketEnd(start time.Time, partition string) time.Time {
+	switch partition {
+	case partitionWeek:
+		return start.AddDate(0, 0, 7)
+	case partitionMonth:
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// bucketTable returns the catalog entry of the bucket table of a partitioned
+// family holding events at t
+func bucketTable(family string, partition string, t time.Time) FamilyPlacement {
+	start := bucketStart(t, partition)
+	return FamilyPlacement{
+		Family:      family + "__" + start.Format(bucketSuffixLayout),
+		Parent:      family,
+		Partition:   partition,
+		BucketStart: &start,
+	}
+}
+
+// partitionOf returns how a family is partitioned, or an empty string if it
+// isn't partitioned or doesn't exist yet
+func partitionOf(family string) string {
+	if buckets := cachedBuckets(family); len(buckets) > 0 {
+		return buckets[0].Partition
+	}
+	if len(placementsOf(family)) > 0 {
+		// Partitioned families only exist as their buckets
+		return ""
+	}
+	buckets := bucketsOf(family)
+	if len(buckets) == 0 {
+		return ""
+	}
+	return buckets[0].Partition
+}
+
+// bucketsOf returns the placement of every bucket of a partitioned family,
+// ordered by the start of the bucket. The catalogs of the shards are only
+// read when no bucket of the family is known yet, since another instance may
+// have created them; buckets it adds later are picked up by refreshCatalog.
+func bucketsOf(family string) []FamilyPlacement {
+	if buckets := cachedBuckets(family); len(buckets) > 0 {
+		return buckets
+	}
+
+	for _, shard := range liveShards() {
+		var found []FamilyPlacement
+		err := shard.DB.Where("parent = ?", family).Find(&found).Error
+		if err != nil {
+			logrus.WithError(err).Warningf("Could not look up the buckets of the %s family in the catalog of %s", family, shard.ID)
+			continue
+		}
+		for _, placement := range found {
+			placement.ShardID = shard.ID
+			cachePlacement(placement)
+		}
+	}
+	return cachedBuckets(family)
+}
+
+// cachedBuckets returns the buckets of a partitioned family in the in-memory
+// catalog, ordered by the start of the bucket
+func cachedBuckets(family string) []FamilyPlacement {
+	catalogLock.RLock()
+	var buckets []FamilyPlacement
+	for _, placements := range catalog {
+		for _, placement := range placements {
+			if placement.Parent == family && placement.BucketStart != nil {
+				buckets = append(buckets, placement)
+			}
+		}
+	}
+	catalogLock.RUnlock()
+
+	sort.Slice(buckets, func(i, j int) bool {
+		if !buckets[i].BucketStart.Equal(*buckets[j].BucketStart) {
+			return buckets[i].BucketStart.Before(*buckets[j].BucketStart)
+		}
+		return buckets[i].ShardID < buckets[j].ShardID
+	})
+	return buckets
+}
+
+// bucketsBetween narrows buckets down to those that can hold events between
+// from and to, either of which may be nil for an open range
+func bucketsBetween(buckets []FamilyPlacement, from *time.Time, to *time.Time) []FamilyPlacement {
+	var between []FamilyPlacement
+	for _, bucket := range buckets {
+		start := *bucket.BucketStart
+		end := bucketEnd(start, bucket.Partition)
+		if from != nil && !end.After(from.Add(-bucketMargin)) {
+			continue
+		}
+		if to != nil && !start.Before(to.Add(bucketMargin)) {
+			continue
+		}
+		between = append(between, bucket)
+	}
+	return between
+}
+
+// timeBounds works out the range of event times a query is limited to from
+// comparisons of the time column with literal times in its outermost WHERE
+// clause. It gives up on clauses with OR at the top level, leaving the range
+// open.
+func timeBounds(statement *sqlStatement) (from *time.Time, to *time.Time) {
+	tokens := statement.Tokens
+	start := -1
+	for i, token := range tokens {
+		if token.Depth == 0 && token.is("WHERE") {
+			start = i + 1
+			break
+		}
+	}
+	if start < 0 {
+		return nil, nil
+	}
+	end := len(tokens)
+	for i := start; i < len(tokens); i++ {
+		token := tokens[i]
+		if token.Depth != 0 {
+			continue
+		}
+		if token.is("GROUP") || token.is("ORDER") || token.is("LIMIT") || token.is("HAVING") || token.is("WINDOW") || token.is("UNION") {
+			end = i
+			break
+		}
+		if token.is("OR") || token.is("XOR") || token.is("||") {
+			return nil, nil
+		}
+	}
+
+	lower := func(t time.Time) {
+		if from == nil || t.After(*from) {
+			from = &t
+		}
+	}
+	upper := func(t time.Time) {
+		if to == nil || t.Before(*to) {
+			to = &t
+		}
+	}
+	for i := start; i+2 < end; i++ {
+		column := tokens[i]
+		if column.Depth != 0 || !strings.EqualFold(column.Text, "time") || (column.Kind != tokenWord && column.Kind != tokenQuoted) {
+			continue
+		}
+		if i > start && tokens[i-1].is("NOT") {
+			continue
+		}
+		op := tokens[i+1]
+		if op.is("BETWEEN") {
+			if i+4 < end && tokens[i+3].is("AND") {
+				low, lowOK := parseLiteralTime(tokens[i+2])
+				high, highOK := parseLiteralTime(tokens[i+4])
+				if lowOK && highOK {
+					lower(low)
+					upper(high)
+				}
+			}
+			continue
+		}
+		value, ok := parseLiteralTime(tokens[i+2])
+		if !ok {
+			continue
+		}
+		switch op.Text {
+		case ">", ">=":
+			lower(value)
+		case "<", "<=":
+			upper(value)
+		case "=":
+			lower(value)
+			upper(value)
+		}
+	}
+
+	return from, to
+}
+
+// parseLiteralTime reads a time from a string literal of a query
+func parseLiteralTime(token sqlToken) (time.Time, bool) {
+	if token.Kind != tokenString || len(token.Text) < 2 {
+		return time.Time{}, false
+	}
+	value := token.Text[1 : len(token.Text)-1]
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999", time.RFC3339Nano, "2006-01-02"} {
+		t, err := time.ParseInLocation(layout, value, time.UTC)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// renameTables rewrites every reference to a table in a query to read
+// another one instead
+func renameTables(query string, references []sqlToken, table string) string {
+	var renamed strings.Builder
+	last := 0
+	for _, reference := range references {
+		renamed.WriteString(query[last:reference.Pos])
+		renamed.WriteString(quoteIdentifier(table))
+		last = reference.End
+	}
+	renamed.WriteString(query[last:])
+	return renamed.String()
+}
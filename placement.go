@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// The strategies --placement can choose between for placing new families
+const (
+	// placementLeastTables puts a family on the connected shard holding the
+	// fewest families, see evenShuffle
+	placementLeastTables = "least_tables"
+	// placementConsistentHash puts a family where the consistent hash ring of
+	// the configured shards says, so every instance agrees on it
+	placementConsistentHash = "consistent_hash"
+	// placementLoadAware puts a family on the shard with the lowest weighted
+	// load, see measureShards
+	placementLoadAware = "load_aware"
+)
+
+// placementError explains why a new family couldn't be placed
+type placementError struct {
+	Family string
+	Reason string
+}
+
+func (e *placementError) Error() string {
+	return fmt.Sprintf("could not place the %s family: %s", e.Family, e.Reason)
+}
+
+// ringPoint is a virtual node of a shard on the hash ring
+type ringPoint struct {
+	Hash    uint64
+	ShardID string
+}
+
+// hashRing is a consistent hash ring over shard IDs. Every shard gets several
+// virtual nodes spread around the ring, so adding or removing a shard only
+// moves the families hashed next to its own nodes.
+type hashRing struct {
+	points []ringPoint
+}
+
+// ring is built over the IDs in configuredShards, leaving out the shards
+// being drained
+var (
+	ring             *hashRing
+	configuredShards []string
+	ringLock         sync.RWMutex
+)
+
+// configureShards sets the IDs of every configured shard, connected or not,
+// and rebuilds the ring over them
+func configureShards(ids []string) {
+	ringLock.Lock()
+	defer ringLock.Unlock()
+	configuredShards = ids
+	var onRing []string
+	for _, id := range ids {
+		if !drainingShards.Has(id) {
+			onRing = append(onRing, id)
+		}
+	}
+	ring = newHashRing(onRing, *placementVnodes)
+}
+
+// shardConfigured reports whether the shard with the given ID is configured
+func shardConfigured(id string) bool {
+	ringLock.RLock()
+	defer ringLock.RUnlock()
+	for _, configured := range configuredShards {
+		if configured == id {
+			return true
+		}
+	}
+	return false
+}
+
+// configuredShardIDs returns the IDs of every configured shard
+func configuredShardIDs() []string {
+	ringLock.RLock()
+	defer ringLock.RUnlock()
+	return configuredShards
+}
+
+// currentRing returns the hash ring placement uses
+func currentRing() *hashRing {
+	ringLock.RLock()
+	defer ringLock.RUnlock()
+	return ring
+}
+
+// newHashRing places vnodes virtual nodes for each of the shard IDs on a ring
+func newHashRing(shardIDs []string, vnodes int) *hashRing {
+	r := &hashRing{}
+	for _, id := range shardIDs {
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, ringPoint{
+				Hash:    ringHash(id + "#" + strconv.Itoa(i)),
+				ShardID: id,
+			})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].Hash != r.points[j].Hash {
+			return r.points[i].Hash < r.points[j].Hash
+		}
+		// Two shards landing on the same point is unlikely, but has to be
+		// resolved the same way everywhere
+		return r.points[i].ShardID < r.points[j].ShardID
+	})
+	return r
+}
+
+// owners returns the IDs of up to n different shards a key belongs to. The
+// first is the shard with the first virtual node at or after the hash of the
+// key, and the others follow it around the ring.
+func (r *hashRing) owners(key string, n int) []string {
+	var ids []string
+	if len(r.points) == 0 {
+		return ids
+	}
+	hash := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].Hash >= hash
+	})
+	seen := map[string]bool{}
+	for i := 0; i < len(r.points) && len(ids) < n; i++ {
+		id := r.points[(start+i)%len(r.points)].ShardID
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// ringHash is the 64-bit FNV-1a hash used for both shards and families
+func ringHash(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	return hash.Sum64()
+}
+
+// placeFamily picks the shards a new family is created on using the strategy
+// chosen with --placement, one for each of its replicas. Whatever the
+// strategy, shards whose data has reached --placement_high_water of their
+// capacity get no new families.
+func placeFamily(family string, replicas int) ([]Shard, error) {
+	switch *placementStrategy {
+	case placementConsistentHash:
+		ids := currentRing().owners(family, replicas)
+		if len(ids) < replicas {
+			return nil, &placementError{Family: family, Reason: fmt.Sprintf("it needs %d shards but only %d are configured", replicas, len(ids))}
+		}
+		var shards []Shard
+		for _, id := range ids {
+			shard, ok := shardByID(id)
+			if !ok || shard.down() {
+				// Falling back to another shard would put the family
+				// somewhere other instances don't expect it, so refuse
+				// until it is back
+				return nil, &placementError{Family: family, Reason: fmt.Sprintf("its shard %s is down", id)}
+			}
+			load, err := measureShard(shard)
+			if err != nil {
+				return nil, &placementError{Family: family, Reason: fmt.Sprintf("could not measure its shard %s: %s", id, err)}
+			}
+			if load.Full {
+				return nil, &placementError{Family: family, Reason: fmt.Sprintf("its shard %s is above the high-water mark", id)}
+			}
+			shards = append(shards, shard)
+		}
+		return shards, nil
+	case placementLoadAware:
+		loads := leastLoaded(measureShards(), replicas)
+		if len(loads) < replicas {
+			return nil, &placementError{Family: family, Reason: fmt.Sprintf("it needs %d shards but only %d are below the high-water mark and can be measured", replicas, len(loads))}
+		}
+		shards := make([]Shard, len(loads))
+		for i, load := range loads {
+			shards[i], _ = shardByID(load.ShardID)
+		}
+		return shards, nil
+	}
+
+	var candidates []Shard
+	for _, load := range measureShards() {
+		if !load.Full && !load.Draining {
+			shard, _ := shardByID(load.ShardID)
+			candidates = append(candidates, shard)
+		}
+	}
+	if len(candidates) < replicas {
+		return nil, &placementError{Family: family, Reason: fmt.Sprintf("it needs %d shards but only %d are below the high-water mark and can be measured", replicas, len(candidates))}
+	}
+	var shards []Shard
+	for len(shards) < replicas {
+		shard := evenShuffle(candidates)
+		shards = append(shards, shard)
+		for i, candidate := range candidates {
+			if candidate.ID == shard.ID {
+				candidates = append(candidates[:i:i], candidates[i+1:]...)
+				break
+			}
+		}
+	}
+	return shards, nil
+}
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+)
+
+// orderTerm is a single column of an ORDER BY clause
+type orderTerm struct {
+	Column string
+	Desc   bool
+}
+
+// queryPlan is what QueryMagic needs to know about a query to route it and to
+// merge the rows coming back when it is sent to several shards
+type queryPlan struct {
+	Statement *sqlStatement
+	Tables    []string
+	OrderBy   []orderTerm
+	// Limit is -1 when the query has no LIMIT clause
+	Limit  int
+	Offset int
+	// ShardSQL is the query sent to every shard when fanning out. Any OFFSET
+	// is folded into the LIMIT so the coordinator can apply it to the merged
+	// rows instead.
+	ShardSQL string
+}
+
+// planQuery works out which families a query reads and how its results have
+// to be merged
+func planQuery(query string) (queryPlan, error) {
+	plan := queryPlan{Limit: -1, ShardSQL: query}
+
+	statement, err := parseSQL(query)
+	if err != nil {
+		return plan, err
+	}
+	if len(statement.Tables) == 0 {
+		return plan, newSQLError(query, 0, "the query doesn't read from any family")
+	}
+	plan.Statement = statement
+	plan.Tables = statement.Tables
+
+	// Only the ORDER BY and LIMIT of the outermost query matter here; the
+	// last ones at depth 0 also cover every SELECT of a UNION
+	tokens := statement.Tokens
+	orderAt, limitAt := -1, -1
+	for i, token := range tokens {
+		if token.Depth != 0 {
+			continue
+		}
+		switch {
+		case token.is("ORDER") && i+1 < len(tokens) && tokens[i+1].is("BY"):
+			orderAt = i
+		case token.is("LIMIT"):
+			limitAt = i
+		case token.is("UNION"):
+			orderAt, limitAt = -1, -1
+		}
+	}
+
+	end := len(tokens)
+	if limitAt >= 0 {
+		limitEnd, err := plan.parseLimit(query, tokens, limitAt)
+		if err != nil {
+			return plan, err
+		}
+		plan.ShardSQL = fmt.Sprintf("%sLIMIT %d%s", query[:tokens[limitAt].Pos], plan.Offset+plan.Limit, query[tokens[limitEnd-1].End:])
+		end = limitAt
+	}
+
+	if orderAt >= 0 && orderAt < end {
+		var term []sqlToken
+		for i := orderAt + 2; i <= end; i++ {
+			if i < end && !(tokens[i].Depth == 0 && (tokens[i].is(",") || tokens[i].is("FOR") || tokens[i].is("LOCK") || tokens[i].is("INTO"))) {
+				term = append(term, tokens[i])
+				continue
+			}
+
+			if len(term) == 0 {
+				return plan, newSQLError(query, tokens[i-1].End, "expected an ORDER BY term")
+			}
+			desc := false
+			if last := term[len(term)-1]; last.is("ASC") || last.is("DESC") {
+				desc = last.is("DESC")
+				term = term[:len(term)-1]
+			}
+			plan.OrderBy = append(plan.OrderBy, orderTerm{
+				Column: query[term[0].Pos:term[len(term)-1].End],
+				Desc:   desc,
+			})
+			term = nil
+
+			if i < end && !tokens[i].is(",") {
+				break
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// parseLimit reads the LIMIT clause starting at the token at index limitAt in
+// any of the forms MySQL accepts: LIMIT n, LIMIT offset, n and
+// LIMIT n OFFSET offset. It returns the index just past the clause.
+func (plan *queryPlan) parseLimit(query string, tokens []sqlToken, limitAt int) (int, error) {
+	number := func(i int) (int, error) {
+		if i >= len(tokens) || tokens[i].Kind != tokenNumber {
+			pos := len(query)
+			if i < len(tokens) {
+				pos = tokens[i].Pos
+			}
+			return 0, newSQLError(query, pos, "expected a number")
+		}
+		n, err := strconv.Atoi(tokens[i].Text)
+		if err != nil {
+			return 0, newSQLError(query, tokens[i].Pos, "expected a number")
+		}
+		return n, nil
+	}
+
+	count, err := number(limitAt + 1)
+	if err != nil {
+		return 0, err
+	}
+	next := limitAt + 2
+	if next < len(tokens) && (tokens[next].is(",") || tokens[next].is("OFFSET")) {
+		second, err := number(next + 1)
+		if err != nil {
+			return 0, err
+		}
+		if tokens[next].is(",") {
+			count, plan.Offset = second, count
+		} else {
+			plan.Offset = second
+		}
+		next += 2
+	}
+	plan.Limit = count
+
+	return next, nil
+}
+
+// shardMessage is sent from a shard to the coordinator: first the result
+// columns, then every row as it is scanned, and an error if the query fails
+type shardMessage struct {
+	Columns []resultColumn
+	Row     []interface{}
+	Err     error
+}
+
+// streamShard runs a query against a single shard and sends the results to
+// out, closing it when done. The query runs inside a read-only transaction,
+// on the read-only connection when the shard has one, so it can't change
+// anything even if it gets past authorizeQuery. Cancelling ctx stops it.
+func streamShard(ctx context.Context, shard Shard, query string, args []interface{}, tables []string, out chan<- shardMessage) {
+	defer close(out)
+
+	send := func(message shardMessage) bool {
+		select {
+		case out <- message:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	fail := func(err error) {
+		// The family was moved by another instance, so where it lives now
+		// is read back from the shards by the next query
+		if missingTable(err) {
+			for _, table := range tables {
+				forgetPlacements(table)
+			}
+		}
+		send(shardMessage{Err: err})
+	}
+
+	db := shard.DB
+	if shard.ReadDB != nil {
+		db = shard.ReadDB
+	}
+
+	// The transaction has to be started and used on the same connection,
+	// which the pool behind gorm doesn't guarantee
+	conn, err := db.DB().Conn(ctx)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "START TRANSACTION READ ONLY")
+	if err != nil {
+		fail(err)
+		return
+	}
+	// Roll back even when ctx has been cancelled, so the connection goes
+	// back to the pool without an open transaction
+	defer conn.ExecContext(context.Background(), "ROLLBACK")
+
+	// Runs before the rollback above, so a late KILL QUERY can't hit it
+	stop, err := killOnCancel(ctx, db, conn)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer stop()
+
+	// Prepared statements make the driver use the binary protocol, which
+	// returns numbers and times typed instead of as text
+	stmt, err := conn.PrepareContext(ctx, query)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		fail(err)
+		return
+	}
+	columns := make([]resultColumn, len(types))
+	for i, column := range types {
+		columns[i] = resultColumn{Name: column.Name(), Type: columnKind(column)}
+	}
+	if !send(shardMessage{Columns: columns}) {
+		return
+	}
+
+	raw := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range raw {
+		dest[i] = &raw[i]
+	}
+	for rows.Next() {
+		err = rows.Scan(dest...)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		row := make([]interface{}, len(columns))
+		for i, value := range raw {
+			row[i] = convertValue(value, columns[i].Type)
+		}
+		if !send(shardMessage{Row: row}) {
+			return
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		fail(err)
+	}
+}
+
+// killOnCancel kills the statement running on conn as soon as ctx is
+// cancelled. The driver can't interrupt a statement by itself, so without
+// this a timed out or abandoned query would keep running on the shard. The
+// returned function stops watching ctx and has to be called before conn is
+// used for anything else.
+func killOnCancel(ctx context.Context, db *gorm.DB, conn *sql.Conn) (func(), error) {
+	var connectionID int64
+	err := conn.QueryRowContext(ctx, "SELECT CONNECTION_ID()").Scan(&connectionID)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			// KILL needs its own connection; the pool is logged in as the
+			// same user, which is allowed to kill its own statements
+			err := db.Exec(fmt.Sprintf("KILL QUERY %d", connectionID)).Error
+			if err != nil {
+				logrus.WithError(err).Warningf("Could not kill query %d", connectionID)
+				return
+			}
+			logrus.Infof("Killed query %d: %s", connectionID, ctx.Err())
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}, nil
+}
+
+// executeQuery runs the query of every target with args concurrently and
+// writes the rows to w as they arrive. With merge set, the plan's ORDER BY is
+// kept by merging the already sorted rows of every target, and its OFFSET and
+// LIMIT are applied to the combined rows. Errors that happen before anything
+// has been written are returned so the caller can respond with a proper
+// status; later ones are reported through w.
+func executeQuery(ctx context.Context, targets []queryTarget, args []interface{}, plan queryPlan, merge bool, w rowWriter) error {
+	ctx, cancel := context.WithCancel(ctx)
+	// Stops the shards still running once we have all the rows we need
+	defer cancel()
+
+	streams := make([]chan shardMessage, len(targets))
+	for i, target := range targets {
+		streams[i] = make(chan shardMessage, 64)
+		go streamShard(ctx, target.Shard, target.Query, args, target.Tables, streams[i])
+	}
+
+	// Every shard sends its columns first, or an error if the query couldn't
+	// even start
+	var columns []resultColumn
+	for _, stream := range streams {
+		message, ok := <-stream
+		if !ok {
+			return ctx.Err()
+		}
+		if message.Err != nil {
+			return message.Err
+		}
+		if columns == nil {
+			columns = uniqueColumnNames(message.Columns)
+		}
+	}
+
+	next, err := mergeStreams(streams, columns, plan, merge)
+	if err != nil {
+		return err
+	}
+
+	// From here on the response has started, so errors can only be reported
+	// through w and failing writes mean the client has gone away
+	err = w.Begin(columns)
+	if err != nil {
+		return nil
+	}
+
+	skip, remaining := 0, -1
+	if merge {
+		skip, remaining = plan.Offset, plan.Limit
+	}
+	for remaining != 0 {
+		row, err := next()
+		if err != nil {
+			err = interruption(ctx, err)
+			logrus.WithError(err).Warning("A query failed while streaming its results")
+			finishResult(w, columns, resultEnd{Err: err})
+			return nil
+		}
+		if row == nil {
+			break
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+
+		noteColumnTypes(columns, row)
+		err = w.Row(row)
+		if err != nil {
+			return nil
+		}
+		if remaining > 0 {
+			remaining--
+		}
+	}
+
+	finishResult(w, columns, resultEnd{})
+	return nil
+}
+
+// interruption explains an error caused by ctx being cancelled, which would
+// otherwise surface as whatever the driver made of the killed statement
+func interruption(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("the query timed out")
+	case context.Canceled:
+		return fmt.Errorf("the query was cancelled")
+	}
+	return err
+}
+
+// noteColumnTypes fills in the type of every column whose type isn't known
+// yet from the values of a row
+func noteColumnTypes(columns []resultColumn, row []interface{}) {
+	for i, value := range row {
+		if columns[i].Type == "" {
+			columns[i].Type = valueKind(value)
+		}
+	}
+}
+
+// finishResult ends a streamed result, reporting the columns that only ever
+// held NULL as such
+func finishResult(w rowWriter, columns []resultColumn, end resultEnd) {
+	for i := range columns {
+		if columns[i].Type == "" {
+			columns[i].Type = "null"
+		}
+	}
+	w.End(columns, end)
+}
+
+// mergeStreams returns a function handing out the rows of every stream, one
+// at a time, and nil once they have all run dry. Rows are merged on the
+// plan's ORDER BY when merge is set and it has one, otherwise every stream is
+// drained in turn.
+func mergeStreams(streams []chan shardMessage, columns []resultColumn, plan queryPlan, merge bool) (func() ([]interface{}, error), error) {
+	receive := func(stream chan shardMessage) ([]interface{}, error) {
+		message, ok := <-stream
+		if !ok {
+			return nil, nil
+		}
+		return message.Row, message.Err
+	}
+
+	if !merge || len(plan.OrderBy) == 0 {
+		current := 0
+		return func() ([]interface{}, error) {
+			for current < len(streams) {
+				row, err := receive(streams[current])
+				if err != nil || row != nil {
+					return row, err
+				}
+				current++
+			}
+			return nil, nil
+		}, nil
+	}
+
+	indexes := make([]int, len(plan.OrderBy))
+	for i, term := range plan.OrderBy {
+		index, err := columnIndex(columns, term.Column)
+		if err != nil {
+			return nil, err
+		}
+		indexes[i] = index
+	}
+	less := func(a, b []interface{}) bool {
+		for i, term := range plan.OrderBy {
+			cmp := compareValues(a[indexes[i]], b[indexes[i]])
+			if cmp == 0 {
+				continue
+			}
+			if term.Desc {
+				return cmp > 0
+			}
+			return cmp < 0
+		}
+		return false
+	}
+
+	// heads holds the next row of every stream, nil once a stream is done
+	var heads [][]interface{}
+	return func() ([]interface{}, error) {
+		if heads == nil {
+			heads = make([][]interface{}, len(streams))
+			for i, stream := range streams {
+				row, err := receive(stream)
+				if err != nil {
+					return nil, err
+				}
+				heads[i] = row
+			}
+		}
+
+		smallest := -1
+		for i, head := range heads {
+			if head != nil && (smallest < 0 || less(head, heads[smallest])) {
+				smallest = i
+			}
+		}
+		if smallest < 0 {
+			return nil, nil
+		}
+
+		row := heads[smallest]
+		next, err := receive(streams[smallest])
+		if err != nil {
+			return nil, err
+		}
+		heads[smallest] = next
+		return row, nil
+	}, nil
+}
+
+// columnIndex finds an ORDER BY column in the result columns, either by name
+// or by its 1-based position
+func columnIndex(columns []resultColumn, column string) (int, error) {
+	if position, err := strconv.Atoi(column); err == nil {
+		if position < 1 || position > len(columns) {
+			return 0, fmt.Errorf("ORDER BY position %d is out of range", position)
+		}
+		return position - 1, nil
+	}
+
+	name := strings.Trim(column, "`")
+	if dot := strings.LastIndex(name, "."); dot >= 0 {
+		name = strings.Trim(name[dot+1:], "`")
+	}
+	for i, c := range columns {
+		if strings.EqualFold(c.Name, name) {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("ORDER BY column %s must be part of the selected columns to merge results across shards", column)
+}
+
+// compareValues compares two scanned values, sorting NULL first like MySQL
+func compareValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+
+	if x, ok := a.(time.Time); ok {
+		if y, ok := b.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1
+			case x.After(y):
+				return 1
+			}
+			return 0
+		}
+	}
+
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// toFloat returns a numeric or boolean value as a float64 for comparisons
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// queryTarget is a shard a query is sent to, along with the tables it reads
+// there
+type queryTarget struct {
+	Shard  Shard
+	Tables []string
+	// Query is filled in by targetQueries
+	Query string
+}
+
+// routeQuery picks the shards to send a query reading tables to. Queries go
+// to the first shard holding every table, or to all of them with fanOut set.
+// Replicated families are read from a single reachable replica either way,
+// one that hasn't missed any writes if there is one. A partitioned family is
+// read from each of its buckets that can hold events between from and to,
+// which always needs the results to be merged. The returned status code goes
+// with the error when the query can't be routed.
+func routeQuery(tables []string, fanOut bool, from *time.Time, to *time.Time) ([]queryTarget, bool, int, error) {
+	for _, table := range tables {
+		if partitionOf(strings.TrimSpace(table)) == "" {
+			continue
+		}
+		if len(tables) > 1 {
+			return nil, false, http.StatusBadRequest, fmt.Errorf("the partitioned family %s can only be queried on its own", table)
+		}
+
+		buckets := readablePlacements(bucketsOf(strings.TrimSpace(table)))
+		between := bucketsBetween(buckets, from, to)
+		if len(buckets) == 0 {
+			return nil, false, http.StatusServiceUnavailable, fmt.Errorf("the buckets of the %s family are still being migrated", table)
+		}
+		if len(between) == 0 {
+			// Reading any bucket still gives the right columns, and the
+			// time range of the query leaves out all of its rows
+			between = buckets[len(buckets)-1:]
+		}
+		// The replicas of a bucket are next to each other, and any one of
+		// them will do
+		var targets []queryTarget
+		for start, end := 0, 0; start < len(between); start = end {
+			var replicas []Shard
+			for end = start; end < len(between) && between[end].Family == between[start].Family; end++ {
+				if shard, ok := shardByID(between[end].ShardID); ok {
+					replicas = append(replicas, shard)
+				}
+			}
+			shard, ok := readReplica(inSync([]string{between[start].Family}, replicas))
+			if !ok {
+				return nil, false, http.StatusServiceUnavailable, fmt.Errorf("no reachable shard holds the %s bucket", between[start].Family)
+			}
+			targets = append(targets, queryTarget{Shard: shard, Tables: []string{between[start].Family}})
+		}
+		return targets, true, 0, nil
+	}
+
+	shards := shardsHolding(tables)
+	if len(shards) == 0 {
+		return nil, false, http.StatusNotFound, fmt.Errorf("Sorry wasn't able to locate a family that matches requested")
+	}
+	if replicated(tables) {
+		shard, ok := readReplica(inSync(tables, shards))
+		if !ok {
+			return nil, false, http.StatusServiceUnavailable, fmt.Errorf("none of the shards holding the families are reachable")
+		}
+		shards = []Shard{shard}
+	} else if !fanOut {
+		shards = shards[:1]
+	}
+	targets := make([]queryTarget, len(shards))
+	for i, shard := range shards {
+		targets[i] = queryTarget{Shard: shard, Tables: tables}
+	}
+	return targets, fanOut, 0, nil
+}
+
+// targetQueries fills in the query sent to every target. Merged results need
+// the plan's shard query, and targets reading a time bucket get the family
+// renamed to the bucket in it.
+func targetQueries(targets []queryTarget, query string, plan queryPlan, merge bool) error {
+	for i, target := range targets {
+		targetQuery, targetPlan := query, plan
+		if len(plan.Tables) == 1 && target.Tables[0] != plan.Tables[0] {
+			if len(plan.Statement.References) != 1 {
+				return fmt.Errorf("a partitioned family can only be named once in a query")
+			}
+			targetQuery = renameTables(query, plan.Statement.References, target.Tables[0])
+			var err error
+			targetPlan, err = planQuery(targetQuery)
+			if err != nil {
+				return err
+			}
+		}
+		if merge {
+			targetQuery = targetPlan.ShardSQL
+		}
+		targets[i].Query = targetQuery
+	}
+	return nil
+}
+
+// shardsHolding returns every shard that has all of the given families, not
+// counting the copies migrations are still making
+func shardsHolding(tables []string) []Shard {
+	var shards []Shard
+	for _, shard := range liveShards() {
+		holdsAll := true
+		for _, table := range tables {
+			if !onShard(readablePlacements(placementsOf(strings.TrimSpace(table))), shard.ID) {
+				holdsAll = false
+				break
+			}
+		}
+		if holdsAll {
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// deniedFunctions can read server files, hold locks or tie up a connection,
+// none of which a client query has any business doing
+var deniedFunctions = map[string]bool{
+	"BENCHMARK":    true,
+	"GET_LOCK":     true,
+	"LOAD_FILE":    true,
+	"RELEASE_LOCK": true,
+	"SLEEP":        true,
+}
+
+// authorizeQuery makes sure a client query only reads from known families.
+// Only SELECT statements are allowed, and they may not write files, take
+// locks or touch tables that aren't families, such as the raw logs table or
+// tables in other databases.
+func authorizeQuery(statement *sqlStatement) error {
+	if statement.Type != "SELECT" {
+		return fmt.Errorf("%s statements are not allowed, only SELECT", statement.Type)
+	}
+
+	tokens := statement.Tokens
+	for i, token := range tokens {
+		switch {
+		case token.is("INTO"):
+			return fmt.Errorf("SELECT ... INTO is not allowed")
+		case token.is("LOCK"), token.is("FOR") && i+1 < len(tokens) && (tokens[i+1].is("UPDATE") || tokens[i+1].is("SHARE")):
+			return fmt.Errorf("locking reads are not allowed")
+		// MySQL calls the built-in function for a quoted name too
+		case (token.Kind == tokenWord || token.Kind == tokenQuoted) && deniedFunctions[strings.ToUpper(token.Text)] && i+1 < len(tokens) && tokens[i+1].is("("):
+			return fmt.Errorf("the %s function is not allowed", strings.ToUpper(token.Text))
+		}
+	}
+
+	internal := internalTables()
+	for _, table := range statement.Tables {
+		if strings.Contains(table, ".") {
+			return fmt.Errorf("%s is not a family; tables in other databases can't be queried", table)
+		}
+		if internal[strings.ToLower(table)] {
+			return fmt.Errorf("%s is an internal table and can't be queried", table)
+		}
+	}
+
+	return nil
+}
+
+// internalTables returns the names of the tables the service keeps for itself
+// on every shard, such as the raw logs table and the placement catalog
+func internalTables() map[string]bool {
+	tables := map[string]bool{}
+	shards := connectedShards()
+	if len(shards) == 0 {
+		return tables
+	}
+	for _, table := range databaseTables {
+		tables[strings.ToLower(shards[0].DB.NewScope(table).TableName())] = true
+	}
+	return tables
+}
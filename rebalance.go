@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// rebalanceMove is a family the rebalancer wants to move to another shard
+type rebalanceMove struct {
+	Family     string  `json:"family"`
+	Source     string  `json:"source"`
+	Target     string  `json:"target"`
+	DataBytes  int64   `json:"data_bytes"`
+	Rows       int64   `json:"rows"`
+	IngestRate float64 `json:"ingest_rate"`
+}
+
+// rebalancePlan is what the rebalancer would do about the current load of the
+// shards
+type rebalancePlan struct {
+	Shards []shardLoad `json:"shards"`
+	// Imbalance is the difference between the load scores of the busiest
+	// shard and the least busy one that isn't full
+	Imbalance float64         `json:"imbalance"`
+	Threshold float64         `json:"threshold"`
+	Moves     []rebalanceMove `json:"moves"`
+	// ProjectedImbalance is what Imbalance should come down to once every
+	// move is done
+	ProjectedImbalance float64 `json:"projected_imbalance"`
+}
+
+// rebalancerStatus is the state of the rebalancer as shown by the admin API
+type rebalancerStatus struct {
+	Enabled bool       `json:"enabled"`
+	Running bool       `json:"running"`
+	LastRun *time.Time `json:"last_run,omitempty"`
+	// Paused says why the rebalancer is waiting, if it is
+	Paused   string            `json:"paused,omitempty"`
+	LastPlan *rebalancePlan    `json:"last_plan,omitempty"`
+	Moves    []migrationStatus `json:"moves"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// rebalancer holds the state of the rebalancer and the migrations of its
+// current or last run
+var rebalancer struct {
+	sync.Mutex
+	status     rebalancerStatus
+	migrations []*familyMigration
+}
+
+// simulatedShard is a shard whose figures change as moves are planned
+type simulatedShard struct {
+	Load shardLoad
+	// Movable are the families the rebalancer may move off the shard
+	Movable []rebalanceMove
+}
+
+// planRebalance works out which families to move to bring the load scores
+// of the shards within --rebalance_threshold of each other. Moves are picked
+// greedily, each one taking the family off the busiest shard that best evens
+// it out with the least busy one.
+func planRebalance() rebalancePlan {
+	loads := measureShards()
+	plan := rebalancePlan{
+		Shards:    loads,
+		Threshold: *rebalanceThreshold,
+		Moves:     []rebalanceMove{},
+	}
+
+	shards := make([]*simulatedShard, len(loads))
+	for i, load := range loads {
+		shards[i] = &simulatedShard{Load: load}
+		shard, _ := shardByID(load.ShardID)
+		movable, err := movableFamilies(shard)
+		if err != nil {
+			logrus.WithError(err).Warningf("Could not measure the families of %s", load.ShardID)
+			continue
+		}
+		shards[i].Movable = movable
+	}
+
+	// Scores stay relative to the figures at the start so that planned
+	// moves can be compared with each other
+	scale := scaleOf(loads)
+	busiest, idlest, imbalance := spread(shards)
+	plan.Imbalance = imbalance
+
+	for len(plan.Moves) < *rebalanceMaxMoves && imbalance > *rebalanceThreshold {
+		from, to := shards[busiest], shards[idlest]
+		best, bestGap := -1, imbalance
+		for i, move := range from.Movable {
+			toBytes := to.Load.DataBytes + move.DataBytes
+			if to.Load.Capacity > 0 && float64(toBytes)/float64(to.Load.Capacity) >= *placementHighWater {
+				continue
+			}
+			fromScore := scale.score(from.Load.DataBytes-move.DataBytes, from.Load.Rows-move.Rows, from.Load.IngestRate-move.IngestRate, from.Load.Weight)
+			toScore := scale.score(toBytes, to.Load.Rows+move.Rows, to.Load.IngestRate+move.IngestRate, to.Load.Weight)
+			if gap := math.Abs(fromScore - toScore); gap < bestGap {
+				best, bestGap = i, gap
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		move := from.Movable[best]
+		move.Target = to.Load.ShardID
+		from.Movable = append(from.Movable[:best:best], from.Movable[best+1:]...)
+		from.Load.DataBytes -= move.DataBytes
+		from.Load.Rows -= move.Rows
+		from.Load.IngestRate -= move.IngestRate
+		from.Load.Score = scale.score(from.Load.DataBytes, from.Load.Rows, from.Load.IngestRate, from.Load.Weight)
+		to.Load.DataBytes += move.DataBytes
+		to.Load.Rows += move.Rows
+		to.Load.IngestRate += move.IngestRate
+		to.Load.Score = scale.score(to.Load.DataBytes, to.Load.Rows, to.Load.IngestRate, to.Load.Weight)
+		plan.Moves = append(plan.Moves, move)
+
+		busiest, idlest, imbalance = spread(shards)
+	}
+	plan.ProjectedImbalance = imbalance
+
+	return plan
+}
+
+// spread returns the busiest shard, the least busy one that isn't full or
+// draining and the difference between their scores
+func spread(shards []*simulatedShard) (busiest int, idlest int, imbalance float64) {
+	busiest, idlest = -1, -1
+	for i, shard := range shards {
+		if busiest < 0 || shard.Load.Score > shards[busiest].Load.Score {
+			busiest = i
+		}
+		if !shard.Load.Full && !shard.Load.Draining && (idlest < 0 || shard.Load.Score < shards[idlest].Load.Score) {
+			idlest = i
+		}
+	}
+	if busiest < 0 || idlest < 0 || busiest == idlest {
+		return busiest, idlest, 0
+	}
+	return busiest, idlest, shards[busiest].Load.Score - shards[idlest].Load.Score
+}
+
+// movableFamilies returns the size and ingest rate of every family on the
+// shard that can be migrated, which excludes families on several shards and
+// those that are already being migrated
+func movableFamilies(shard Shard) ([]rebalanceMove, error) {
+	rows, err := shard.DB.Raw("SELECT TABLE_NAME, COALESCE(DATA_LENGTH + INDEX_LENGTH, 0), COALESCE(TABLE_ROWS, 0) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE()").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sizes := map[string]rebalanceMove{}
+	for rows.Next() {
+		var move rebalanceMove
+		err = rows.Scan(&move.Family, &move.DataBytes, &move.Rows)
+		if err != nil {
+			return nil, err
+		}
+		sizes[move.Family] = move
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	var movable []rebalanceMove
+	for _, placement := range catalogOf(shard.ID) {
+		if placement.Status != placementActive || len(placementsOf(placement.Family)) > 1 {
+			continue
+		}
+		move, ok := sizes[placement.Family]
+		if !ok {
+			continue
+		}
+		move.Source = shard.ID
+		move.IngestRate = familyIngest.rate(placement.Family)
+		movable = append(movable, move)
+	}
+	return movable, nil
+}
+
+// rebalanceHold gives the reason the rebalancer should hold off, which is any
+// shard the health checker doesn't consider up, or nothing when every shard
+// is fine
+func rebalanceHold() string {
+	for _, shard := range connectedShards() {
+		if state := shard.Health.state(); state != shardUp {
+			return fmt.Sprintf("%s is %s", shard.ID, state)
+		}
+	}
+	databasesLock.RLock()
+	defer databasesLock.RUnlock()
+	if len(unreachable) > 0 {
+		return fmt.Sprintf("%s has not been connected to", unreachable[0].ID)
+	}
+	return ""
+}
+
+// startRebalance marks the rebalancer as running, unless it already is
+func startRebalance() bool {
+	rebalancer.Lock()
+	defer rebalancer.Unlock()
+	if rebalancer.status.Running {
+		return false
+	}
+	now := time.Now()
+	rebalancer.status.Running = true
+	rebalancer.status.LastRun = &now
+	rebalancer.status.Error = ""
+	rebalancer.migrations = nil
+	return true
+}
+
+// setRebalancePause records why the rebalancer is waiting
+func setRebalancePause(reason string) {
+	rebalancer.Lock()
+	defer rebalancer.Unlock()
+	rebalancer.status.Paused = reason
+}
+
+// runRebalance plans a rebalance and carries it out, running at most
+// --rebalance_concurrency migrations at a time. Nothing new is started while
+// a shard is unhealthy, and the copies already running pause until it
+// recovers. The rebalancer must have been marked running by startRebalance.
+func runRebalance() {
+	defer func() {
+		rebalancer.Lock()
+		rebalancer.status.Running = false
+		rebalancer.status.Paused = ""
+		rebalancer.Unlock()
+	}()
+
+	plan := planRebalance()
+	rebalancer.Lock()
+	rebalancer.status.LastPlan = &plan
+	rebalancer.Unlock()
+	if len(plan.Moves) == 0 {
+		logrus.Debugf("The shards are balanced to within %.2f", plan.Imbalance)
+		return
+	}
+	logrus.Infof("Rebalancing %d families to bring the imbalance from %.2f to %.2f", len(plan.Moves), plan.Imbalance, plan.ProjectedImbalance)
+
+	slots := make(chan struct{}, *rebalanceConcurrency)
+	var running sync.WaitGroup
+	for _, move := range plan.Moves {
+		for reason := rebalanceHold(); reason != ""; reason = rebalanceHold() {
+			setRebalancePause(reason)
+			time.Sleep(10 * time.Second)
+		}
+		setRebalancePause("")
+
+		slots <- struct{}{}
+		migration, _, err := startMigration(move.Family, move.Source, move.Target, migrationOptions{
+			BatchSize: defaultMigrationBatch,
+			Throttle:  *rebalanceThrottle,
+			Hold:      rebalanceHold,
+		})
+		if err != nil {
+			<-slots
+			logrus.WithError(err).Warningf("Could not start moving the %s family to %s", move.Family, move.Target)
+			continue
+		}
+		rebalancer.Lock()
+		rebalancer.migrations = append(rebalancer.migrations, migration)
+		rebalancer.Unlock()
+
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			migration.wait()
+			<-slots
+		}()
+	}
+	running.Wait()
+}
+
+// rebalanceLoop runs the rebalancer every --rebalance_interval
+func rebalanceLoop() {
+	for {
+		time.Sleep(*rebalanceInterval)
+		if startRebalance() {
+			runRebalance()
+		}
+	}
+}
+
+// ShowRebalance is the admin handler showing the state of the rebalancer
+func ShowRebalance(c *gin.Context) {
+	rebalancer.Lock()
+	status := rebalancer.status
+	status.Moves = make([]migrationStatus, len(rebalancer.migrations))
+	for i, migration := range rebalancer.migrations {
+		status.Moves[i] = migration.snapshot()
+	}
+	rebalancer.Unlock()
+
+	c.JSON(http.StatusOK, status)
+}
+
+// PlanRebalance is the admin handler showing what the rebalancer would do
+// right now, without doing it
+func PlanRebalance(c *gin.Context) {
+	c.JSON(http.StatusOK, planRebalance())
+}
+
+// StartRebalance is the admin handler running the rebalancer right away
+func StartRebalance(c *gin.Context) {
+	if !startRebalance() {
+		c.JSON(http.StatusConflict, map[string]string{
+			"message": "The rebalancer is already running",
+		})
+		return
+	}
+	go runRebalance()
+	c.JSON(http.StatusAccepted, map[string]string{
+		"message": "The rebalancer has been started",
+	})
+}
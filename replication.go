@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// The acknowledgements an ingest request can wait for, set with --write_ack
+// or the ack option of the request
+const (
+	// ackOne succeeds as soon as a single replica has stored the events
+	ackOne = "one"
+	// ackQuorum needs a majority of the replicas
+	ackQuorum = "quorum"
+	// ackAll needs every replica
+	ackAll = "all"
+)
+
+// validateReplication checks the replicas and ack options of an ingest request
+func validateReplication(body IngestLogBody) map[string]string {
+	fieldErrors := map[string]string{}
+
+	if body.Replicas < 0 {
+		fieldErrors["replicas"] = "The number of replicas must be at least 1"
+	}
+	switch body.Ack {
+	case "", ackOne, ackQuorum, ackAll:
+	default:
+		fieldErrors["ack"] = fmt.Sprintf("%q is not a supported ack, use one, quorum or all", body.Ack)
+	}
+
+	return fieldErrors
+}
+
+// requiredAcks returns how many of the replicas of a family have to store the
+// events of an ingest request asking for ack
+func requiredAcks(ack string, replicas int) int {
+	if ack == "" {
+		ack = *writeAck
+	}
+	switch ack {
+	case ackOne:
+		return 1
+	case ackAll:
+		return replicas
+	}
+	return replicas/2 + 1
+}
+
+// replicaCount returns the replication factor a family was created with.
+// Catalog rows from before replication count as a single replica.
+func (placement FamilyPlacement) replicaCount() int {
+	if placement.Replicas < 1 {
+		return 1
+	}
+	return placement.Replicas
+}
+
+// replicationOf returns the replication factor of a family, or 0 if it doesn't
+// exist yet. The buckets of a partitioned family all share its factor.
+func replicationOf(family string) int {
+	var placements []FamilyPlacement
+	if partitionOf(family) != "" {
+		placements = bucketsOf(family)
+	} else {
+		placements = placementsOf(family)
+	}
+	if len(placements) == 0 {
+		return 0
+	}
+	return placements[0].replicaCount()
+}
+
+// replica is a shard the events of a family table are written to
+type replica struct {
+	Shard Shard
+	// Status is the status of the placement on the shard as this instance
+	// knows it, which the write checks against the catalog of the shard
+	Status string
+	// Incoming is the shard a migration is copying the table to from this
+	// one, which gets every row written here with the same id
+	Incoming *Shard
+}
+
+// replicasOf returns the replicas that aren't down the events of a family
+// table are written to, along with its replication factor, which is 0 if the
+// table doesn't exist yet. A family that isn't replicated is written to the
+// first shard holding it. While a placement is migrating, the shard it is
+// migrating to is included as its incoming shard, unless that is down.
+func replicasOf(table string) ([]replica, int) {
+	placements := placementsOf(table)
+	if len(placements) == 0 {
+		return nil, 0
+	}
+	factor := placements[0].replicaCount()
+
+	var incoming *Shard
+	for _, placement := range placements {
+		if placement.Status != placementIncoming {
+			continue
+		}
+		if shard, ok := shardByID(placement.ShardID); ok && !shard.down() {
+			incoming = &shard
+		}
+	}
+
+	var replicas []replica
+	for _, placement := range readablePlacements(placements) {
+		shard, ok := shardByID(placement.ShardID)
+		if !ok || shard.down() {
+			continue
+		}
+		written := replica{Shard: shard, Status: placement.Status}
+		if placement.Status == placementMigrating {
+			written.Incoming = incoming
+		}
+		replicas = append(replicas, written)
+		if factor == 1 {
+			break
+		}
+	}
+	return replicas, factor
+}
+
+// replicated reports whether any of the families is copied to several shards,
+// in which case its placements hold the same rows rather than a part of them
+func replicated(tables []string) bool {
+	for _, table := range tables {
+		if replicationOf(table) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// readReplica picks one of the shards to read from, starting at a random one
+// to spread queries between replicas. Shards that are up are preferred over
+// degraded ones, and those that are down are never picked.
+func readReplica(shards []Shard) (Shard, bool) {
+	if len(shards) == 0 {
+		return Shard{}, false
+	}
+	start := rand.Intn(len(shards))
+	for _, wanted := range []string{shardUp, shardDegraded} {
+		for i := range shards {
+			shard := shards[(start+i)%len(shards)]
+			if shard.Health.state() == wanted {
+				return shard, true
+			}
+		}
+	}
+	return Shard{}, false
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resultColumn describes a column of a query result
+type resultColumn struct {
+	Name string `json:"name"`
+	// Type is one of int, float, bool, time, string, json or, when every
+	// value of the column was NULL and nothing else is known about it, null
+	Type string `json:"type"`
+}
+
+// columnKind returns the result type of a column from the type the shard
+// reports for it, or an empty string when the driver doesn't say, in which
+// case the type is taken from the values. Family bool columns are the only
+// TINYINT columns we create.
+func columnKind(column *sql.ColumnType) string {
+	switch strings.TrimPrefix(strings.ToUpper(column.DatabaseTypeName()), "UNSIGNED ") {
+	case "":
+		return scanTypeKind(column.ScanType())
+	case "TINYINT":
+		return "bool"
+	case "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "YEAR":
+		return "int"
+	case "FLOAT", "DOUBLE", "DECIMAL":
+		return "float"
+	case "TIMESTAMP", "DATETIME", "DATE":
+		return "time"
+	case "JSON":
+		return "json"
+	}
+	return "string"
+}
+
+// scanTypeKind returns the result type of a column the driver only gives the
+// Go type of. Bytes can hold anything, so they tell us nothing.
+func scanTypeKind(scanType reflect.Type) string {
+	if scanType == nil {
+		return ""
+	}
+	switch scanType {
+	case reflect.TypeOf(time.Time{}):
+		return "time"
+	case reflect.TypeOf(sql.NullInt64{}):
+		return "int"
+	case reflect.TypeOf(sql.NullFloat64{}):
+		return "float"
+	}
+	switch scanType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "int"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.Bool:
+		return "bool"
+	case reflect.String:
+		return "string"
+	}
+	return ""
+}
+
+// convertValue turns a value scanned from the driver into the value returned
+// to clients, using the column type when it is known
+func convertValue(value interface{}, kind string) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case int64:
+		if kind == "bool" {
+			return v != 0
+		}
+		return v
+	case float32:
+		return float64(v)
+	case []byte:
+		switch kind {
+		case "json":
+			if json.Valid(v) {
+				return json.RawMessage(v)
+			}
+		case "float":
+			if f, err := strconv.ParseFloat(string(v), 64); err == nil {
+				return f
+			}
+		case "int":
+			if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+				return i
+			}
+		}
+		return string(v)
+	}
+	return value
+}
+
+// valueKind returns the result type of a converted value
+func valueKind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return ""
+	case int64:
+		return "int"
+	case float64:
+		return "float"
+	case bool:
+		return "bool"
+	case time.Time:
+		return "time"
+	case json.RawMessage:
+		return "json"
+	}
+	return "string"
+}
+
+// uniqueColumnNames renames columns sharing a name, as happens when joining
+// families, by adding their position to the later ones so every column can
+// be a key of the result objects
+func uniqueColumnNames(columns []resultColumn) []resultColumn {
+	unique := make([]resultColumn, len(columns))
+	seen := map[string]bool{}
+	for i, column := range columns {
+		if seen[column.Name] {
+			column.Name = column.Name + "_" + strconv.Itoa(i+1)
+		}
+		seen[column.Name] = true
+		unique[i] = column
+	}
+	return unique
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+)
+
+// identifierPattern matches the family and field names we are willing to use
+// as MySQL table and column names. Anything else is rejected before it gets
+// anywhere near a SQL statement.
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+
+// reservedColumns are created on every family table by createNewTable and
+// can't be declared in a family schema
+var reservedColumns = map[string]bool{
+	"id":   true,
+	"time": true,
+}
+
+// columnMapping describes how a data type declared in a family schema is
+// stored by a particular SQL dialect
+type columnMapping struct {
+	// Definition is the type used in CREATE TABLE and ALTER TABLE statements
+	Definition string
+	// DataType is the DATA_TYPE information_schema reports for the column
+	DataType string
+}
+
+// columnTypes maps every data type a family schema may declare to the column
+// used for it, keyed by the name of the gorm dialect of the shard. Shards are
+// only opened with the mysql dialect for now.
+var columnTypes = map[string]map[string]columnMapping{
+	"string": {
+		"mysql": {Definition: "varchar(255)", DataType: "varchar"},
+	},
+	"text": {
+		"mysql": {Definition: "LONGTEXT", DataType: "longtext"},
+	},
+	"int": {
+		"mysql": {Definition: "INT", DataType: "int"},
+	},
+	"bigint": {
+		"mysql": {Definition: "BIGINT", DataType: "bigint"},
+	},
+	"float": {
+		"mysql": {Definition: "DOUBLE", DataType: "double"},
+	},
+	"bool": {
+		"mysql": {Definition: "BOOLEAN", DataType: "tinyint"},
+	},
+	// MySQL gives the first TIMESTAMP column of a table an automatic default
+	// unless it is explicitly nullable, which would shadow our own time column
+	"timestamp": {
+		"mysql": {Definition: "TIMESTAMP NULL", DataType: "timestamp"},
+	},
+	"datetime": {
+		"mysql": {Definition: "DATETIME", DataType: "datetime"},
+	},
+	"json": {
+		"mysql": {Definition: "JSON", DataType: "json"},
+	},
+}
+
+// columnFor returns the column used for a declared data type on db
+func columnFor(db *gorm.DB, declared string) (columnMapping, error) {
+	dialect := db.Dialect().GetName()
+	mapping, ok := columnTypes[declared][dialect]
+	if !ok {
+		return mapping, fmt.Errorf("the %s data type is not supported by the %s dialect", declared, dialect)
+	}
+	return mapping, nil
+}
+
+// validIdentifier reports whether name is safe to use as a table or column name
+func validIdentifier(name string) bool {
+	return identifierPattern.MatchString(name)
+}
+
+// quoteIdentifier wraps a validated identifier in backticks so it can't be
+// confused with a MySQL keyword
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// validateSchema checks the family name and every field of the schema map and
+// returns a map of field name to error message for everything that is wrong
+func validateSchema(body IngestLogBody) map[string]string {
+	fieldErrors := map[string]string{}
+
+	if !validIdentifier(body.Family) {
+		fieldErrors["family"] = fmt.Sprintf("%q is not a valid family name", body.Family)
+	}
+
+	for field, columnType := range body.Schema {
+		switch {
+		case !validIdentifier(field):
+			fieldErrors[field] = fmt.Sprintf("%q is not a valid field name", field)
+		case reservedColumns[strings.ToLower(field)]:
+			fieldErrors[field] = fmt.Sprintf("%q is a reserved column name", field)
+		default:
+			if _, ok := columnTypes[columnType]; !ok {
+				fieldErrors[field] = fmt.Sprintf("Unsupported data type %s", columnType)
+			}
+		}
+	}
+
+	return fieldErrors
+}
+
+// encodeValue converts a decoded JSON value into the value we bind to the
+// INSERT statement for a column of the given schema type
+func encodeValue(columnType string, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	switch columnType {
+	case "string", "text":
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a string but got %T", value)
+		}
+		return s, nil
+	case "int":
+		i, err := encodeInteger(value)
+		if err != nil {
+			return nil, err
+		}
+		if i < math.MinInt32 || i > math.MaxInt32 {
+			return nil, fmt.Errorf("%d is out of range for an int", i)
+		}
+		return i, nil
+	case "bigint":
+		return encodeInteger(value)
+	case "float":
+		f, ok := value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("expected a float but got %T", value)
+		}
+		return f, nil
+	case "bool":
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expected a bool but got %T", value)
+		}
+		return b, nil
+	case "timestamp", "datetime":
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected an RFC3339 time but got %T", value)
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, fmt.Errorf("expected an RFC3339 time but got %q", s)
+		}
+		return t.UTC(), nil
+	case "json":
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return string(encoded), nil
+	}
+
+	return nil, fmt.Errorf("unsupported data type %s", columnType)
+}
+
+// encodeInteger accepts integers either as JSON numbers or, for values too
+// large to survive the trip through a float64, as decimal strings
+func encodeInteger(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return 0, fmt.Errorf("expected an integer but got %v", v)
+		}
+		return int64(v), nil
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("expected an integer but got %q", v)
+		}
+		return i, nil
+	}
+
+	return 0, fmt.Errorf("expected an integer but got %T", value)
+}
+
+// tableColumns returns the live columns of table keyed by lower-cased column
+// name, with the DATA_TYPE information_schema reports for each of them
+func tableColumns(db *gorm.DB, table string) (map[string]string, error) {
+	rows, err := db.Raw(
+		"SELECT COLUMN_NAME, DATA_TYPE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?",
+		table,
+	).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := map[string]string{}
+	for rows.Next() {
+		var name, dataType string
+		err = rows.Scan(&name, &dataType)
+		if err != nil {
+			return nil, err
+		}
+		columns[strings.ToLower(name)] = strings.ToLower(dataType)
+	}
+
+	return columns, rows.Err()
+}
+
+// evolveSchema brings the family table on the shard in line with the schema
+// declared in the request. Fields the table doesn't have yet are added with
+// ALTER TABLE. Fields whose declared type doesn't match the existing column
+// are left alone and returned keyed by field name so the caller can reject
+// the request.
+func evolveSchema(db *gorm.DB, body IngestLogBody) (map[string]string, error) {
+	existing, err := tableColumns(db, body.Family)
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts := map[string]string{}
+	columns := map[string]columnMapping{}
+	var missing []string
+	for field, declared := range body.Schema {
+		column, err := columnFor(db, declared)
+		if err != nil {
+			return nil, err
+		}
+		columns[field] = column
+
+		dataType, ok := existing[strings.ToLower(field)]
+		if !ok {
+			missing = append(missing, field)
+			continue
+		}
+		if dataType != column.DataType {
+			conflicts[field] = fmt.Sprintf("declared as %s but the existing column is %s", declared, dataType)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return conflicts, nil
+	}
+
+	for _, field := range missing {
+		logrus.Infof("Adding the %s field of type %s to the %s log family", field, body.Schema[field], body.Family)
+		err = db.Exec(fmt.Sprintf(
+			"ALTER TABLE %s ADD COLUMN %s %s",
+			quoteIdentifier(body.Family),
+			quoteIdentifier(field),
+			columns[field].Definition,
+		)).Error
+		if err == nil {
+			continue
+		}
+
+		// Another request may have added the same column in the meantime,
+		// which is fine as long as it agrees with us on the type
+		current, lookupErr := tableColumns(db, body.Family)
+		if lookupErr != nil || current[strings.ToLower(field)] != columns[field].DataType {
+			return nil, err
+		}
+	}
+
+	return conflicts, nil
+}
+
+// declaredType maps a DATA_TYPE reported by information_schema back to the
+// family schema type stored that way by the given dialect
+func declaredType(dialect string, dataType string) (string, bool) {
+	for declared, mappings := range columnTypes {
+		if mapping, ok := mappings[dialect]; ok && mapping.DataType == dataType {
+			return declared, true
+		}
+	}
+	return "", false
+}
+
+// familyColumns returns the schema type of every column the tables of all
+// of the given targets have, keyed by lower-cased column name. Columns of a
+// type the schema can't declare are left out.
+func familyColumns(targets []queryTarget) (map[string]string, error) {
+	var common map[string]string
+	for _, target := range targets {
+		shard := target.Shard
+		existing, err := tableColumns(shard.DB, target.Tables[0])
+		if err != nil {
+			return nil, err
+		}
+
+		columns := map[string]string{}
+		for name, dataType := range existing {
+			declared, ok := declaredType(shard.DB.Dialect().GetName(), dataType)
+			if !ok {
+				continue
+			}
+			if common == nil || common[name] == declared {
+				columns[name] = declared
+			}
+		}
+		common = columns
+	}
+	return common, nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// schemaLockName is the MySQL named lock instances take while migrating a
+// shard, so that instances starting together don't apply the same migration
+// twice
+const schemaLockName = "databalancer_schema_migrations"
+
+// schemaLockTimeout is how long an instance waits for another one to finish
+// migrating a shard
+const schemaLockTimeout = 5 * time.Minute
+
+// SchemaVersion records a schema migration applied to the shard it is stored
+// on
+type SchemaVersion struct {
+	Version   int `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// schemaMigration is a forward change to the tables the service keeps on
+// every shard. Up must be safe to run again, since it can fail after changing
+// the schema but before being recorded, and must never throw away data.
+type schemaMigration struct {
+	Version int
+	Name    string
+	Up      func(db *gorm.DB) error
+}
+
+// schemaMigrations are applied in order. New migrations are added at the end
+// with the next version; released ones are never changed. They spell out
+// their DDL rather than deriving it from the structs, which keep changing.
+var schemaMigrations = []schemaMigration{
+	{
+		Version: 1,
+		Name:    "create the raw logs table",
+		Up: func(db *gorm.DB) error {
+			return db.Exec("CREATE TABLE IF NOT EXISTS `raw_logs` (" +
+				"`id` int unsigned AUTO_INCREMENT, " +
+				"`family` varchar(255), " +
+				"`log` varchar(255), " +
+				"PRIMARY KEY (`id`))").Error
+		},
+	},
+	{
+		Version: 2,
+		Name:    "create the placement catalog",
+		Up: func(db *gorm.DB) error {
+			return db.Exec("CREATE TABLE IF NOT EXISTS `family_placements` (" +
+				"`family` varchar(64), " +
+				"`shard_id` varchar(255), " +
+				"`schema` text, " +
+				"`created_at` timestamp NULL, " +
+				"`row_estimate` bigint, " +
+				"`status` varchar(32), " +
+				"PRIMARY KEY (`family`, `shard_id`))").Error
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add time buckets to the placement catalog",
+		Up: func(db *gorm.DB) error {
+			err := addColumn(db, "family_placements", "parent", "varchar(64)")
+			if err == nil {
+				err = addColumn(db, "family_placements", "partition", "varchar(16)")
+			}
+			if err == nil {
+				err = addColumn(db, "family_placements", "bucket_start", "timestamp NULL")
+			}
+			if err != nil || db.Dialect().HasIndex("family_placements", "idx_family_placements_parent") {
+				return err
+			}
+			return db.Exec("CREATE INDEX `idx_family_placements_parent` ON `family_placements` (`parent`)").Error
+		},
+	},
+	{
+		Version: 4,
+		Name:    "add replicas to the placement catalog",
+		Up: func(db *gorm.DB) error {
+			return addColumn(db, "family_placements", "replicas", "int")
+		},
+	},
+	{
+		Version: 5,
+		Name:    "create the shard state table",
+		Up: func(db *gorm.DB) error {
+			return db.Exec("CREATE TABLE IF NOT EXISTS `shard_states` (" +
+				"`shard_id` varchar(255), " +
+				"`draining` boolean, " +
+				"`updated_at` timestamp NULL, " +
+				"PRIMARY KEY (`shard_id`))").Error
+		},
+	},
+	{
+		Version: 6,
+		Name:    "create the replica hints table",
+		Up: func(db *gorm.DB) error {
+			err := db.Exec("CREATE TABLE IF NOT EXISTS `replica_hints` (" +
+				"`id` int unsigned AUTO_INCREMENT, " +
+				"`family` varchar(64), " +
+				"`shard_id` varchar(255), " +
+				"`schema` text, " +
+				"`columns` text, " +
+				"`rows` mediumtext, " +
+				"`raw_logs` mediumtext, " +
+				"`created_at` timestamp NULL, " +
+				"PRIMARY KEY (`id`))").Error
+			if err != nil || db.Dialect().HasIndex("replica_hints", "idx_replica_hints_shard_id") {
+				return err
+			}
+			return db.Exec("CREATE INDEX `idx_replica_hints_shard_id` ON `replica_hints` (`shard_id`)").Error
+		},
+	},
+}
+
+// addColumn adds a column to a table unless the table already has it, which
+// shards that predate the schema migrations may
+func addColumn(db *gorm.DB, table string, column string, definition string) error {
+	if db.Dialect().HasColumn(table, column) {
+		return nil
+	}
+	return db.Exec(fmt.Sprintf("ALTER TABLE %s ADD %s %s", quoteIdentifier(table), quoteIdentifier(column), definition)).Error
+}
+
+// schemaStatus is the schema version of a shard as shown by the admin API
+type schemaStatus struct {
+	ShardID string `json:"shard_id"`
+	Version int    `json:"version"`
+	Latest  int    `json:"latest"`
+	Pending []int  `json:"pending"`
+	Error   string `json:"error,omitempty"`
+}
+
+// latestSchemaVersion returns the version of the last schema migration
+func latestSchemaVersion() int {
+	return schemaMigrations[len(schemaMigrations)-1].Version
+}
+
+// appliedVersions returns the versions of the schema migrations applied to a
+// shard
+func appliedVersions(shard Shard) (map[int]bool, error) {
+	applied := map[int]bool{}
+	if !shard.DB.HasTable(&SchemaVersion{}) {
+		return applied, nil
+	}
+	var versions []SchemaVersion
+	err := shard.DB.Find(&versions).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		applied[version.Version] = true
+		if version.Version > latestSchemaVersion() {
+			logrus.Warningf("%s has schema version %d, which is newer than this build knows about", shard.ID, version.Version)
+		}
+	}
+	return applied, nil
+}
+
+// pendingMigrations returns the schema migrations a shard hasn't had yet
+func pendingMigrations(shard Shard) ([]schemaMigration, error) {
+	applied, err := appliedVersions(shard)
+	if err != nil {
+		return nil, err
+	}
+	var pending []schemaMigration
+	for _, migration := range schemaMigrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// migrateShard applies the schema migrations a shard hasn't had yet, in
+// order, recording each one as soon as it succeeds
+func migrateShard(shard Shard) (int, error) {
+	ctx := context.Background()
+	conn, err := shard.DB.DB().Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// Named locks belong to a MySQL session, so the lock is taken and
+	// released on the same connection
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", schemaLockName, int(schemaLockTimeout/time.Second)).Scan(&locked)
+	if err != nil {
+		return 0, err
+	}
+	if !locked.Valid || locked.Int64 != 1 {
+		return 0, fmt.Errorf("timed out waiting for another instance to finish migrating %s", shard.ID)
+	}
+	defer conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", schemaLockName)
+
+	err = shard.DB.Exec("CREATE TABLE IF NOT EXISTS `schema_versions` (" +
+		"`version` int, " +
+		"`name` varchar(255), " +
+		"`applied_at` timestamp NULL, " +
+		"PRIMARY KEY (`version`))").Error
+	if err != nil {
+		return 0, err
+	}
+	pending, err := pendingMigrations(shard)
+	if err != nil {
+		return 0, err
+	}
+	for i, migration := range pending {
+		err = migration.Up(shard.DB)
+		if err != nil {
+			return i, fmt.Errorf("schema migration %d (%s) failed: %s", migration.Version, migration.Name, err)
+		}
+		err = shard.DB.Create(&SchemaVersion{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			AppliedAt: time.Now(),
+		}).Error
+		if err != nil {
+			return i, err
+		}
+		logrus.Infof("Applied schema migration %d (%s) to %s", migration.Version, migration.Name, shard.ID)
+	}
+	return len(pending), nil
+}
+
+// prepareSchema brings the schema of a shard up to date before it is used,
+// or with --no-auto_migrate checks that it already is
+func prepareSchema(shard Shard) error {
+	if *autoMigrate {
+		_, err := migrateShard(shard)
+		return err
+	}
+	pending, err := pendingMigrations(shard)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%s is missing %d schema migrations, run the migrate command", shard.ID, len(pending))
+	}
+	return nil
+}
+
+// connectTopology connects to every configured shard for the commands that
+// run once and exit, and stops at the first one it can't reach
+func connectTopology() []Shard {
+	topology, err := loadTopology()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid shard topology")
+	}
+	var shards []Shard
+	for _, config := range topology {
+		shard, err := connectShard(config)
+		if err != nil {
+			logrus.WithError(err).Fatalf("Could not establish a connection to %s", config.ID)
+		}
+		shards = append(shards, shard)
+	}
+	return shards
+}
+
+// runMigrateCommand applies the pending schema migrations to every shard, or
+// only lists them with --dry_run
+func runMigrateCommand() {
+	failed := false
+	for _, shard := range connectTopology() {
+		if *migrateDryRun {
+			pending, err := pendingMigrations(shard)
+			if err != nil {
+				logrus.WithError(err).Errorf("Could not read the schema version of %s", shard.ID)
+				failed = true
+				continue
+			}
+			for _, migration := range pending {
+				logrus.Infof("%s would get schema migration %d (%s)", shard.ID, migration.Version, migration.Name)
+			}
+			if len(pending) == 0 {
+				logrus.Infof("%s is up to date", shard.ID)
+			}
+			continue
+		}
+
+		applied, err := migrateShard(shard)
+		if err != nil {
+			logrus.WithError(err).Errorf("Could not migrate %s", shard.ID)
+			failed = true
+			continue
+		}
+		logrus.Infof("%s is up to date after %d schema migrations", shard.ID, applied)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// runWipeRawLogsCommand deletes the raw logs of the shards given with
+// --shard, or of every shard. This is the only way the service throws away
+// raw logs, and it has to be confirmed with --yes.
+func runWipeRawLogsCommand() {
+	if !*wipeConfirm {
+		logrus.Fatal("Wiping raw logs can't be undone, pass --yes to go ahead")
+	}
+	shards := connectTopology()
+	if len(*wipeShards) > 0 {
+		byID := map[string]Shard{}
+		for _, shard := range shards {
+			byID[shard.ID] = shard
+		}
+		shards = nil
+		for _, id := range *wipeShards {
+			shard, ok := byID[id]
+			if !ok {
+				logrus.Fatalf("%s is not a configured shard", id)
+			}
+			shards = append(shards, shard)
+		}
+	}
+
+	for _, shard := range shards {
+		if !shard.DB.HasTable(&RawLog{}) {
+			continue
+		}
+		table := shard.DB.NewScope(&RawLog{}).TableName()
+		err := shard.DB.Exec(fmt.Sprintf("TRUNCATE TABLE %s", quoteIdentifier(table))).Error
+		if err != nil {
+			logrus.WithError(err).Fatalf("Could not wipe the raw logs of %s", shard.ID)
+		}
+		logrus.Warningf("Wiped the raw logs of %s", shard.ID)
+	}
+}
+
+// ShowSchema is the admin handler showing the schema version of every
+// connected shard
+func ShowSchema(c *gin.Context) {
+	shards := []schemaStatus{}
+	for _, shard := range connectedShards() {
+		status := schemaStatus{ShardID: shard.ID, Latest: latestSchemaVersion(), Pending: []int{}}
+		applied, err := appliedVersions(shard)
+		if err != nil {
+			status.Error = err.Error()
+		}
+		for _, migration := range schemaMigrations {
+			if applied[migration.Version] {
+				status.Version = migration.Version
+			} else {
+				status.Pending = append(status.Pending, migration.Version)
+			}
+		}
+		shards = append(shards, status)
+	}
+	sort.Slice(shards, func(i, j int) bool {
+		return shards[i].ShardID < shards[j].ShardID
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"shards": shards,
+	})
+}
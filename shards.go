@@ -0,0 +1,439 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fatih/set"
+	"github.com/gin-gonic/gin"
+)
+
+// The states a drain of a shard goes through
+const (
+	drainRunning = "draining"
+	// drainStopped is a drain that went through every family but couldn't
+	// move some of them, and can be started again
+	drainStopped = "stopped"
+	drainDone    = "drained"
+)
+
+// drainingShards holds the IDs of the shards being drained, which get no new
+// families
+var drainingShards = set.New()
+
+// ShardState is what the admin API has changed about a shard. It is kept on
+// the shard itself, so that every instance sees it and it outlives restarts.
+type ShardState struct {
+	ShardID   string `gorm:"primary_key;size:255"`
+	Draining  bool
+	UpdatedAt time.Time
+}
+
+// saveDraining records on the shard whether it is being drained
+func saveDraining(shard Shard, draining bool) error {
+	return shard.DB.Save(&ShardState{ShardID: shard.ID, Draining: draining}).Error
+}
+
+// loadDraining reads from the shard whether it is being drained, which may
+// have been decided by another instance or before a restart, and takes it off
+// the hash ring or puts it back accordingly
+func loadDraining(shard Shard) error {
+	var states []ShardState
+	err := shard.DB.Where("shard_id = ?", shard.ID).Find(&states).Error
+	if err != nil {
+		return err
+	}
+	draining := len(states) > 0 && states[0].Draining
+	if draining == drainingShards.Has(shard.ID) {
+		return nil
+	}
+	if draining {
+		drainingShards.Add(shard.ID)
+	} else {
+		drainingShards.Remove(shard.ID)
+	}
+	configureShards(configuredShardIDs())
+	return nil
+}
+
+// inTopology looks a shard up in the topology as it is configured now, which
+// for --shards_file and --config means reading the file again
+func inTopology(id string) (ShardConfig, bool, error) {
+	topology, err := loadTopology()
+	if err != nil {
+		return ShardConfig{}, false, err
+	}
+	for _, config := range topology {
+		if config.ID == id {
+			return config, true, nil
+		}
+	}
+	return ShardConfig{}, false, nil
+}
+
+// shardAdminLock keeps registering and decommissioning shards one at a time
+var shardAdminLock sync.Mutex
+
+// ShardActionBody is the format of the JSON required in the body of a request
+// to the RegisterShard, DrainShard and DecommissionShard handlers
+type ShardActionBody struct {
+	ShardID string `json:"shard_id" binding:"required"`
+}
+
+// drainStatus is the progress of a drain as shown by the admin API
+type drainStatus struct {
+	ShardID string `json:"shard_id"`
+	State   string `json:"state"`
+	// Remaining is the number of families still on the shard
+	Remaining int               `json:"remaining_families"`
+	Moves     []migrationStatus `json:"moves"`
+	Errors    []string          `json:"errors,omitempty"`
+	Started   time.Time         `json:"started"`
+	Finished  *time.Time        `json:"finished,omitempty"`
+}
+
+// shardDrain moves every family off a shard, one at a time
+type shardDrain struct {
+	mu         sync.Mutex
+	status     drainStatus
+	migrations []*familyMigration
+}
+
+// drains holds the latest drain of every shard, keyed by shard ID
+var (
+	drains     = map[string]*shardDrain{}
+	drainsLock sync.Mutex
+)
+
+// snapshot returns a copy of the progress of the drain
+func (d *shardDrain) snapshot() drainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := d.status
+	status.Moves = make([]migrationStatus, len(d.migrations))
+	for i, migration := range d.migrations {
+		status.Moves[i] = migration.snapshot()
+	}
+	status.Errors = append([]string(nil), d.status.Errors...)
+	return status
+}
+
+// failed records a family the drain couldn't move
+func (d *shardDrain) failed(family string, err error) {
+	logrus.WithError(err).Warningf("Could not move the %s family off %s", family, d.status.ShardID)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status.Errors = append(d.status.Errors, fmt.Sprintf("%s: %s", family, err))
+}
+
+// run migrates every family on the shard to the least loaded shard that
+// doesn't already hold it
+func (d *shardDrain) run(shard Shard) {
+	for _, placement := range catalogOf(shard.ID) {
+		var loads []shardLoad
+		for _, load := range measureShards() {
+			if !placedOn(placement.Family, load.ShardID) {
+				loads = append(loads, load)
+			}
+		}
+		targets := leastLoaded(loads, 1)
+		if len(targets) == 0 {
+			d.failed(placement.Family, fmt.Errorf("no other shard can take it"))
+			continue
+		}
+
+		migration, _, err := startMigration(placement.Family, shard.ID, targets[0].ShardID, migrationOptions{
+			BatchSize: defaultMigrationBatch,
+			Throttle:  *rebalanceThrottle,
+			Hold:      shardsHold(shard.ID, targets[0].ShardID),
+		})
+		if err != nil {
+			d.failed(placement.Family, err)
+			continue
+		}
+		d.mu.Lock()
+		d.migrations = append(d.migrations, migration)
+		d.mu.Unlock()
+
+		status := migration.wait()
+		if status.State == migrationFailed {
+			d.failed(placement.Family, fmt.Errorf("%s", status.Error))
+		}
+	}
+
+	now := time.Now()
+	remaining := len(catalogOf(shard.ID))
+	d.mu.Lock()
+	d.status.Remaining = remaining
+	d.status.Finished = &now
+	d.status.State = drainDone
+	if remaining > 0 {
+		d.status.State = drainStopped
+	}
+	d.mu.Unlock()
+	logrus.Infof("Finished draining %s with %d families left on it", shard.ID, remaining)
+}
+
+// shardsHold returns a hold for migrations between the shards with the given
+// IDs, pausing them while either isn't up
+func shardsHold(ids ...string) func() string {
+	return func() string {
+		for _, id := range ids {
+			shard, ok := shardByID(id)
+			if !ok {
+				return fmt.Sprintf("%s is not connected", id)
+			}
+			if state := shard.Health.state(); state != shardUp {
+				return fmt.Sprintf("%s is %s", id, state)
+			}
+		}
+		return ""
+	}
+}
+
+// closeShard closes the connections to a shard
+func closeShard(shard Shard) {
+	shard.DB.Close()
+	if shard.ReadDB != nil {
+		shard.ReadDB.Close()
+	}
+}
+
+// RegisterShard is the admin handler connecting to a shard that has been
+// added to the topology since the service started, and starting to use it.
+// Only shards of the topology can be registered, so that they are still there
+// after a restart.
+func RegisterShard(c *gin.Context) {
+	var body ShardActionBody
+	err := c.BindJSON(&body)
+	if err != nil {
+		logrus.WithError(err).Errorf("The request did not contain a correctly formatted JSON body")
+		return
+	}
+	id := body.ShardID
+
+	config, found, err := inTopology(id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, map[string]string{
+			"message": fmt.Sprintf("Invalid shard topology: %s", err),
+		})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, map[string]string{
+			"message": fmt.Sprintf("%s is not in the shard topology, add it there first", id),
+		})
+		return
+	}
+
+	shardAdminLock.Lock()
+	defer shardAdminLock.Unlock()
+	if shardConfigured(id) {
+		c.JSON(http.StatusConflict, map[string]string{
+			"message": fmt.Sprintf("%s is already a shard", id),
+		})
+		return
+	}
+
+	shard, err := connectShard(config)
+	if err != nil {
+		logrus.WithError(err).Warningf("Could not connect to the new shard %s", id)
+		c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"message": fmt.Sprintf("Could not connect to %s: %s", id, err),
+		})
+		return
+	}
+	err = attachShard(shard)
+	if err != nil {
+		logrus.WithError(err).Errorf("Could not start using the new shard %s", id)
+		closeShard(shard)
+		c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": "Database error",
+		})
+		return
+	}
+	ids := configuredShardIDs()
+	configureShards(append(ids[:len(ids):len(ids)], id))
+
+	logrus.Infof("Registered %s as a new shard", id)
+	c.JSON(http.StatusCreated, map[string]string{
+		"message": fmt.Sprintf("%s is now a shard", id),
+	})
+}
+
+// DrainShard is the admin handler keeping new families off a shard and moving
+// its families to the other shards
+func DrainShard(c *gin.Context) {
+	var body ShardActionBody
+	err := c.BindJSON(&body)
+	if err != nil {
+		logrus.WithError(err).Errorf("The request did not contain a correctly formatted JSON body")
+		return
+	}
+	shard, ok := shardByID(body.ShardID)
+	if !ok {
+		c.JSON(http.StatusNotFound, map[string]string{
+			"message": fmt.Sprintf("%s is not a connected shard", body.ShardID),
+		})
+		return
+	}
+
+	drainsLock.Lock()
+	if existing, ok := drains[shard.ID]; ok && existing.snapshot().State == drainRunning {
+		drainsLock.Unlock()
+		c.JSON(http.StatusConflict, map[string]string{
+			"message": fmt.Sprintf("%s is already being drained", shard.ID),
+		})
+		return
+	}
+	drain := &shardDrain{status: drainStatus{
+		ShardID:   shard.ID,
+		State:     drainRunning,
+		Remaining: len(catalogOf(shard.ID)),
+		Started:   time.Now(),
+	}}
+	drains[shard.ID] = drain
+	drainsLock.Unlock()
+
+	err = saveDraining(shard, true)
+	if err != nil {
+		logrus.WithError(err).Errorf("Could not record that %s is being drained", shard.ID)
+		drain.mu.Lock()
+		drain.status.State = drainStopped
+		drain.mu.Unlock()
+		c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": "Database error",
+		})
+		return
+	}
+	drainingShards.Add(shard.ID)
+	configureShards(configuredShardIDs())
+	logrus.Infof("Draining %s", shard.ID)
+	go drain.run(shard)
+
+	c.JSON(http.StatusAccepted, drain.snapshot())
+}
+
+// ListDrains is the admin handler showing the latest drain of every shard
+// that has been drained since the service started
+func ListDrains(c *gin.Context) {
+	drainsLock.Lock()
+	statuses := make([]drainStatus, 0, len(drains))
+	for _, drain := range drains {
+		statuses = append(statuses, drain.snapshot())
+	}
+	drainsLock.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Started.Before(statuses[j].Started)
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"drains": statuses,
+	})
+}
+
+// DecommissionShard is the admin handler that stops using a drained shard, or
+// one that has never been connected to, once it has been taken out of the
+// topology. The database itself is left alone.
+func DecommissionShard(c *gin.Context) {
+	var body ShardActionBody
+	err := c.BindJSON(&body)
+	if err != nil {
+		logrus.WithError(err).Errorf("The request did not contain a correctly formatted JSON body")
+		return
+	}
+	id := body.ShardID
+
+	shardAdminLock.Lock()
+	defer shardAdminLock.Unlock()
+	if !shardConfigured(id) {
+		c.JSON(http.StatusNotFound, map[string]string{
+			"message": fmt.Sprintf("%s is not a shard", id),
+		})
+		return
+	}
+	_, found, err := inTopology(id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, map[string]string{
+			"message": fmt.Sprintf("Invalid shard topology: %s", err),
+		})
+		return
+	}
+	if found {
+		c.JSON(http.StatusConflict, map[string]string{
+			"message": fmt.Sprintf("%s is still in the shard topology, take it out first", id),
+		})
+		return
+	}
+
+	if shard, ok := shardByID(id); ok {
+		if !drainingShards.Has(id) {
+			c.JSON(http.StatusConflict, map[string]string{
+				"message": fmt.Sprintf("%s has to be drained before it is decommissioned", id),
+			})
+			return
+		}
+		drainsLock.Lock()
+		drain, ok := drains[id]
+		drainsLock.Unlock()
+		if ok && drain.snapshot().State == drainRunning {
+			c.JSON(http.StatusConflict, map[string]string{
+				"message": fmt.Sprintf("%s is still being drained", id),
+			})
+			return
+		}
+		// Other instances may have placed families here too, so the
+		// catalog on the shard itself is what counts
+		var families int
+		err = shard.DB.Model(&FamilyPlacement{}).Count(&families).Error
+		if err != nil {
+			logrus.WithError(err).Errorf("Could not count the families left on %s", id)
+			c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Database error",
+			})
+			return
+		}
+		if families > 0 {
+			c.JSON(http.StatusConflict, map[string]string{
+				"message": fmt.Sprintf("%s still holds %d families", id, families),
+			})
+			return
+		}
+
+		// The shard starts afresh should it ever be registered again
+		err = saveDraining(shard, false)
+		if err != nil {
+			logrus.WithError(err).Warningf("Could not clear the drain of %s", id)
+		}
+		detachShard(id)
+		closeShard(shard)
+	} else {
+		databasesLock.Lock()
+		var pending []pendingShard
+		for _, waiting := range unreachable {
+			if waiting.ID != id {
+				pending = append(pending, waiting)
+			}
+		}
+		unreachable = pending
+		databasesLock.Unlock()
+	}
+
+	var remaining []string
+	for _, configured := range configuredShardIDs() {
+		if configured != id {
+			remaining = append(remaining, configured)
+		}
+	}
+	drainingShards.Remove(id)
+	configureShards(remaining)
+
+	logrus.Infof("Decommissioned %s", id)
+	c.JSON(http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("%s is no longer a shard; its database has been left as it is", id),
+	})
+}
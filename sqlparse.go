@@ -0,0 +1,524 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// tokenKind says what sort of token the SQL lexer produced
+type tokenKind int
+
+const (
+	// tokenWord is a bare word, either a keyword or an identifier
+	tokenWord tokenKind = iota
+	// tokenQuoted is a backtick quoted identifier; its Text is unquoted
+	tokenQuoted
+	tokenString
+	tokenNumber
+	tokenSymbol
+)
+
+// sqlToken is a single significant token of a SQL statement. Whitespace and
+// comments are dropped by the lexer.
+type sqlToken struct {
+	Kind tokenKind
+	Text string
+	// Pos and End are the byte offsets of the token in the statement
+	Pos int
+	End int
+	// Depth is the number of parentheses the token is nested in
+	Depth int
+}
+
+// is reports whether the token is the given keyword or symbol
+func (t sqlToken) is(text string) bool {
+	return (t.Kind == tokenWord || t.Kind == tokenSymbol) && strings.EqualFold(t.Text, text)
+}
+
+// sqlError is returned for a statement that can't be parsed or routed. It
+// carries the position of the problem so clients can point at it.
+type sqlError struct {
+	Message string
+	// Position is the 0-based byte offset of the problem in the statement
+	Position int
+	// Line and Column are 1-based
+	Line   int
+	Column int
+	Near   string
+}
+
+func (e *sqlError) Error() string {
+	return fmt.Sprintf("%s at line %d column %d near %q", e.Message, e.Line, e.Column, e.Near)
+}
+
+// newSQLError builds a sqlError for the given byte offset of query
+func newSQLError(query string, pos int, format string, args ...interface{}) *sqlError {
+	if pos > len(query) {
+		pos = len(query)
+	}
+	line := 1 + strings.Count(query[:pos], "\n")
+	lineStart := strings.LastIndex(query[:pos], "\n") + 1
+	near := query[pos:]
+	if len(near) > 20 {
+		near = near[:20]
+	}
+	return &sqlError{
+		Message:  fmt.Sprintf(format, args...),
+		Position: pos,
+		Line:     line,
+		Column:   1 + utf8.RuneCountInString(query[lineStart:pos]),
+		Near:     near,
+	}
+}
+
+// multiSymbols are the operators made of more than one character, longest first
+var multiSymbols = []string{"<=>", "<=", ">=", "<>", "!=", "||", "&&", ":=", "<<", ">>", "->>", "->"}
+
+// tokenize splits a statement into tokens, tracking how deeply each one is
+// nested in parentheses
+func tokenize(query string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	var open []int
+	i := 0
+
+	for i < len(query) {
+		ch := query[i]
+		start := i
+
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\f':
+			i++
+			continue
+		case ch == '#' || (strings.HasPrefix(query[i:], "--") && (i+2 == len(query) || query[i+2] <= ' ')):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 1
+			}
+			continue
+		case strings.HasPrefix(query[i:], "/*"):
+			// MySQL runs what is inside /*! ... */, MariaDB also what is
+			// inside /*M! ... */, and /*+ ... */ holds optimizer hints, so
+			// they can't be dropped like other comments
+			if strings.HasPrefix(query[i:], "/*!") || strings.HasPrefix(query[i:], "/*M!") || strings.HasPrefix(query[i:], "/*+") {
+				return nil, newSQLError(query, start, "executable comments and optimizer hints are not supported")
+			}
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return nil, newSQLError(query, start, "unterminated comment")
+			}
+			i += end + 4
+			continue
+		case ch == '\'' || ch == '"' || ch == '`':
+			end, ok := scanQuoted(query, i)
+			if !ok {
+				if ch == '`' {
+					return nil, newSQLError(query, start, "unterminated quoted identifier")
+				}
+				return nil, newSQLError(query, start, "unterminated string")
+			}
+			i = end
+			if ch == '`' {
+				name := strings.Replace(query[start+1:end-1], "``", "`", -1)
+				tokens = append(tokens, sqlToken{Kind: tokenQuoted, Text: name, Pos: start, End: end, Depth: len(open)})
+			} else {
+				tokens = append(tokens, sqlToken{Kind: tokenString, Text: query[start:end], Pos: start, End: end, Depth: len(open)})
+			}
+			continue
+		case isDigit(ch) || (ch == '.' && i+1 < len(query) && isDigit(query[i+1])):
+			for i < len(query) && (isWordChar(query[i]) || query[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, sqlToken{Kind: tokenNumber, Text: query[start:i], Pos: start, End: i, Depth: len(open)})
+			continue
+		case isWordChar(ch) || ch == '@':
+			for i < len(query) && (isWordChar(query[i]) || query[i] == '@') {
+				i++
+			}
+			tokens = append(tokens, sqlToken{Kind: tokenWord, Text: query[start:i], Pos: start, End: i, Depth: len(open)})
+			continue
+		case ch == '(':
+			tokens = append(tokens, sqlToken{Kind: tokenSymbol, Text: "(", Pos: start, End: i + 1, Depth: len(open)})
+			open = append(open, start)
+			i++
+			continue
+		case ch == ')':
+			if len(open) == 0 {
+				return nil, newSQLError(query, start, "unexpected closing parenthesis")
+			}
+			open = open[:len(open)-1]
+			tokens = append(tokens, sqlToken{Kind: tokenSymbol, Text: ")", Pos: start, End: i + 1, Depth: len(open)})
+			i++
+			continue
+		}
+
+		symbol := query[i : i+1]
+		for _, s := range multiSymbols {
+			if strings.HasPrefix(query[i:], s) {
+				symbol = s
+				break
+			}
+		}
+		i += len(symbol)
+		tokens = append(tokens, sqlToken{Kind: tokenSymbol, Text: symbol, Pos: start, End: i, Depth: len(open)})
+	}
+
+	if len(open) > 0 {
+		return nil, newSQLError(query, open[len(open)-1], "unclosed parenthesis")
+	}
+
+	return tokens, nil
+}
+
+// scanQuoted finds the end of the quoted string or identifier starting at
+// start, honouring doubled quotes and, for strings, backslash escapes
+func scanQuoted(query string, start int) (int, bool) {
+	quote := query[start]
+	for i := start + 1; i < len(query); i++ {
+		switch {
+		case query[i] == '\\' && quote != '`':
+			i++
+		case query[i] == quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func isWordChar(ch byte) bool {
+	return ch == '_' || ch == '$' || isDigit(ch) || ch >= 0x80 ||
+		(ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+// reservedWords can't be used as bare table names or aliases, so they end a
+// table reference
+var reservedWords = map[string]bool{
+	"ALL": true, "AND": true, "AS": true, "ASC": true, "BETWEEN": true,
+	"BY": true, "CROSS": true, "DESC": true, "DISTINCT": true, "EXCEPT": true,
+	"EXISTS": true, "FOR": true, "FORCE": true, "FROM": true, "FULL": true,
+	"GROUP": true, "HAVING": true, "IGNORE": true, "IN": true, "INNER": true,
+	"INTERSECT": true, "INTO": true, "IS": true, "JOIN": true, "LATERAL": true,
+	"LEFT": true, "LIKE": true, "LIMIT": true, "LOCK": true, "NATURAL": true, "NOT": true,
+	"NULL": true, "OFFSET": true, "ON": true, "OR": true, "ORDER": true,
+	"OUTER": true, "PARTITION": true, "PROCEDURE": true, "RIGHT": true,
+	"SELECT": true, "SET": true, "STRAIGHT_JOIN": true, "TABLE": true,
+	"UNION": true, "UPDATE": true, "USE": true, "USING": true, "VALUES": true,
+	"WHERE": true, "WINDOW": true, "WITH": true,
+}
+
+// sqlStatement is the result of parsing a single SQL statement
+type sqlStatement struct {
+	// Type is the upper-cased keyword saying what the statement does, such as
+	// SELECT or DELETE. Statements starting with WITH take the type of the
+	// statement following the common table expressions.
+	Type string
+	// Tables lists every table the statement references, without duplicates
+	// and excluding common table expressions. Tables qualified with a
+	// database keep the qualifier, as in "otherdb.table".
+	Tables []string
+	// References holds the token of every place an unqualified table is
+	// named, so the statement can be rewritten to read another table
+	References []sqlToken
+	Tokens     []sqlToken
+}
+
+// sqlParser walks the tokens of a statement collecting table references
+type sqlParser struct {
+	query      string
+	tokens     []sqlToken
+	ctes       map[string]bool
+	seen       map[string]bool
+	tables     []string
+	references []sqlToken
+}
+
+// parseSQL tokenizes and parses a single SQL statement
+func parseSQL(query string) (*sqlStatement, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, newSQLError(query, 0, "empty query")
+	}
+
+	// A trailing semicolon is fine, anything after it is a second statement
+	for i, token := range tokens {
+		if token.is(";") {
+			if i != len(tokens)-1 {
+				return nil, newSQLError(query, tokens[i+1].Pos, "only a single statement can be run per query")
+			}
+			tokens = tokens[:i]
+			break
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, newSQLError(query, 0, "empty query")
+	}
+
+	p := &sqlParser{
+		query:  query,
+		tokens: tokens,
+		ctes:   map[string]bool{},
+		seen:   map[string]bool{},
+	}
+	statement := &sqlStatement{Tokens: tokens}
+
+	first := 0
+	for first < len(tokens) && tokens[first].is("(") {
+		first++
+	}
+	if first == len(tokens) || tokens[first].Kind != tokenWord {
+		return nil, newSQLError(query, tokens[0].Pos, "expected a SQL statement")
+	}
+	statement.Type = strings.ToUpper(tokens[first].Text)
+
+	if statement.Type == "WITH" {
+		statementAt, err := p.parseCTEs(first + 1)
+		if err != nil {
+			return nil, err
+		}
+		statement.Type = strings.ToUpper(tokens[statementAt].Text)
+	}
+	if statement.Type == "DESC" {
+		statement.Type = "DESCRIBE"
+	}
+
+	err = p.collectTables(statement.Type, first)
+	if err != nil {
+		return nil, err
+	}
+	statement.Tables = p.tables
+	statement.References = p.references
+
+	return statement, nil
+}
+
+// parseCTEs records the names of the common table expressions following WITH
+// and returns the index of the statement they belong to
+func (p *sqlParser) parseCTEs(i int) (int, error) {
+	if i < len(p.tokens) && p.tokens[i].is("RECURSIVE") {
+		i++
+	}
+	for {
+		if i >= len(p.tokens) || (p.tokens[i].Kind != tokenWord && p.tokens[i].Kind != tokenQuoted) {
+			return 0, p.errorAt(i, "expected a common table expression name")
+		}
+		p.ctes[strings.ToLower(p.tokens[i].Text)] = true
+		i++
+		if i < len(p.tokens) && p.tokens[i].is("(") {
+			i = p.skipParens(i)
+		}
+		if i >= len(p.tokens) || !p.tokens[i].is("AS") {
+			return 0, p.errorAt(i, "expected AS")
+		}
+		i++
+		if i >= len(p.tokens) || !p.tokens[i].is("(") {
+			return 0, p.errorAt(i, "expected a parenthesized query")
+		}
+		i = p.skipParens(i)
+		if i < len(p.tokens) && p.tokens[i].is(",") {
+			i++
+			continue
+		}
+		if i >= len(p.tokens) || p.tokens[i].Kind != tokenWord {
+			return 0, p.errorAt(i, "expected a statement after the common table expressions")
+		}
+		return i, nil
+	}
+}
+
+// skipParens returns the index just past the parenthesis opened at i
+func (p *sqlParser) skipParens(i int) int {
+	depth := p.tokens[i].Depth
+	for i++; i < len(p.tokens); i++ {
+		if p.tokens[i].is(")") && p.tokens[i].Depth == depth {
+			return i + 1
+		}
+	}
+	return i
+}
+
+// clauseEnds are the keywords that end a FROM clause, or the table list of
+// an UPDATE
+var clauseEnds = map[string]bool{
+	"EXCEPT": true, "FOR": true, "GROUP": true, "HAVING": true, "INTERSECT": true,
+	"INTO": true, "LIMIT": true, "LOCK": true, "ORDER": true, "PROCEDURE": true,
+	"SET": true, "UNION": true, "WHERE": true, "WINDOW": true,
+}
+
+// opensSubquery reports whether the parenthesis at i starts a query
+func (p *sqlParser) opensSubquery(i int) bool {
+	if i+1 >= len(p.tokens) {
+		return false
+	}
+	next := p.tokens[i+1]
+	return next.is("SELECT") || next.is("WITH") || next.is("TABLE") || next.is("VALUES") || next.is("(")
+}
+
+// collectTables walks every token of the statement and records the tables
+// named after FROM, JOIN and the other keywords that introduce tables
+func (p *sqlParser) collectTables(statementType string, first int) error {
+	// open holds, for every currently open parenthesis, whether it is a
+	// subquery so FROM inside functions like EXTRACT(YEAR FROM x) is ignored
+	var open []bool
+	// inClause holds the depths at which a FROM clause is being read, where
+	// every comma starts another table reference, including one following
+	// the ON condition of a join or an index hint
+	inClause := map[int]bool{}
+
+	for i := 0; i < len(p.tokens); i++ {
+		token := p.tokens[i]
+		if token.Kind == tokenWord && clauseEnds[strings.ToUpper(token.Text)] {
+			inClause[token.Depth] = false
+		}
+
+		switch {
+		case token.is("("):
+			open = append(open, p.opensSubquery(i))
+			inClause[token.Depth+1] = false
+		case token.is(")"):
+			open = open[:len(open)-1]
+		case token.is(",") && inClause[token.Depth]:
+			_, err := p.parseTableRef(i+1, false)
+			if err != nil {
+				return err
+			}
+		case token.is("FROM"):
+			if len(open) > 0 && !open[len(open)-1] {
+				continue
+			}
+			inClause[token.Depth] = true
+			_, err := p.parseTableRef(i+1, false)
+			if err != nil {
+				return err
+			}
+		case token.is("JOIN") || token.is("STRAIGHT_JOIN") || token.is("INTO"):
+			if token.is("INTO") && i+1 < len(p.tokens) && (p.tokens[i+1].is("OUTFILE") || p.tokens[i+1].is("DUMPFILE") || strings.HasPrefix(p.tokens[i+1].Text, "@")) {
+				continue
+			}
+			_, err := p.parseTableRef(i+1, false)
+			if err != nil {
+				return err
+			}
+		case token.is("UPDATE") && i == first:
+			next := i + 1
+			for next < len(p.tokens) && (p.tokens[next].is("LOW_PRIORITY") || p.tokens[next].is("IGNORE")) {
+				next++
+			}
+			inClause[token.Depth] = true
+			_, err := p.parseTableRef(next, false)
+			if err != nil {
+				return err
+			}
+		case token.is("TABLE"):
+			// CREATE/DROP/ALTER/TRUNCATE/RENAME TABLE, or MySQL 8's TABLE t,
+			// which can also follow UNION or open a subquery
+			next := i + 1
+			for next < len(p.tokens) && (p.tokens[next].is("IF") || p.tokens[next].is("NOT") || p.tokens[next].is("EXISTS")) {
+				next++
+			}
+			_, err := p.parseTableRef(next, true)
+			if err != nil {
+				return err
+			}
+		case (statementType == "DESCRIBE" || statementType == "TRUNCATE") && i == first:
+			next := i + 1
+			if next < len(p.tokens) && p.tokens[next].is("TABLE") {
+				continue
+			}
+			_, err := p.parseTableRef(next, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseTableRef reads the table reference starting at i, along with any alias,
+// and, when list is set, the comma separated references following it. It
+// returns the index of the first token it didn't consume.
+func (p *sqlParser) parseTableRef(i int, list bool) (int, error) {
+	for {
+		if i >= len(p.tokens) {
+			return i, p.errorAt(i, "expected a table name")
+		}
+
+		token := p.tokens[i]
+		switch {
+		case token.is("LATERAL"):
+			i++
+			continue
+		case token.is("("):
+			// Either a derived table, whose own tables are picked up as the
+			// walk continues, or a parenthesized join whose first table is
+			// read here
+			if i+1 < len(p.tokens) && !p.opensSubquery(i) {
+				_, err := p.parseTableRef(i+1, true)
+				if err != nil {
+					return i, err
+				}
+			}
+			i = p.skipParens(i)
+		case token.Kind == tokenQuoted || (token.Kind == tokenWord && !reservedWords[strings.ToUpper(token.Text)]):
+			name := token.Text
+			i++
+			if i+1 < len(p.tokens) && p.tokens[i].is(".") && (p.tokens[i+1].Kind == tokenQuoted || p.tokens[i+1].Kind == tokenWord) {
+				name = name + "." + p.tokens[i+1].Text
+				i += 2
+			} else if !p.ctes[strings.ToLower(name)] {
+				p.references = append(p.references, token)
+			}
+			p.addTable(name)
+		default:
+			return i, p.errorAt(i, "expected a table name")
+		}
+
+		// Skip an alias
+		if i < len(p.tokens) && p.tokens[i].is("AS") {
+			i++
+		}
+		if i < len(p.tokens) && (p.tokens[i].Kind == tokenQuoted || p.tokens[i].Kind == tokenString ||
+			(p.tokens[i].Kind == tokenWord && !reservedWords[strings.ToUpper(p.tokens[i].Text)])) {
+			i++
+		}
+
+		if !list || i >= len(p.tokens) || !p.tokens[i].is(",") {
+			return i, nil
+		}
+		i++
+	}
+}
+
+// addTable records a referenced table unless it names a common table
+// expression or has been seen already
+func (p *sqlParser) addTable(name string) {
+	key := strings.ToLower(name)
+	if p.ctes[key] || p.seen[key] {
+		return
+	}
+	p.seen[key] = true
+	p.tables = append(p.tables, name)
+}
+
+// errorAt builds a sqlError pointing at the token at index i, or at the end of
+// the statement when i is past the last token
+func (p *sqlParser) errorAt(i int, format string, args ...interface{}) error {
+	pos := len(p.query)
+	if i < len(p.tokens) {
+		pos = p.tokens[i].Pos
+	}
+	return newSQLError(p.query, pos, format, args...)
+}
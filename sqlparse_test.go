@@ -0,0 +1,165 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSQLTables(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		typ    string
+		tables []string
+	}{
+		{"plain select", "SELECT * FROM dog", "SELECT", []string{"dog"}},
+		{"trailing semicolon", "SELECT * FROM dog;", "SELECT", []string{"dog"}},
+		{"line comment", "SELECT * FROM dog -- FROM raw_logs\n", "SELECT", []string{"dog"}},
+		{"hash comment", "SELECT * FROM dog # FROM raw_logs", "SELECT", []string{"dog"}},
+		{"block comment", "SELECT /* FROM raw_logs */ * FROM dog", "SELECT", []string{"dog"}},
+		{"double dash without space", "SELECT 1--1 FROM dog", "SELECT", []string{"dog"}},
+		{"string", "SELECT 'FROM raw_logs' FROM dog", "SELECT", []string{"dog"}},
+		{"doubled quote", "SELECT 'it''s FROM raw_logs' FROM dog", "SELECT", []string{"dog"}},
+		{"escaped quote", `SELECT 'it\'s FROM raw_logs' FROM dog`, "SELECT", []string{"dog"}},
+		{"double quoted string", `SELECT "FROM raw_logs" FROM dog`, "SELECT", []string{"dog"}},
+		{"backticks", "SELECT * FROM `dog`", "SELECT", []string{"dog"}},
+		{"doubled backtick", "SELECT * FROM `dog``s`", "SELECT", []string{"dog`s"}},
+		{"qualified", "SELECT * FROM databalancer.raw_logs", "SELECT", []string{"databalancer.raw_logs"}},
+		{"comma list", "SELECT * FROM dog AS d, cat c", "SELECT", []string{"dog", "cat"}},
+		{"join", "SELECT * FROM dog JOIN cat ON dog.id = cat.id", "SELECT", []string{"dog", "cat"}},
+		{"comma after a join condition", "SELECT * FROM dog JOIN cat ON 1 = 1, raw_logs", "SELECT", []string{"dog", "cat", "raw_logs"}},
+		{"comma after an index hint", "SELECT * FROM dog d USE INDEX (x), raw_logs", "SELECT", []string{"dog", "raw_logs"}},
+		{"comma after a partition", "SELECT * FROM dog PARTITION (p0), raw_logs", "SELECT", []string{"dog", "raw_logs"}},
+		{"parenthesized join", "SELECT * FROM dog LEFT JOIN (cat, raw_logs) ON 1 = 1", "SELECT", []string{"dog", "cat", "raw_logs"}},
+		{"subquery", "SELECT (SELECT log FROM raw_logs LIMIT 1) FROM dog", "SELECT", []string{"raw_logs", "dog"}},
+		{"derived table", "SELECT * FROM dog, (SELECT * FROM raw_logs) r", "SELECT", []string{"dog", "raw_logs"}},
+		{"lateral", "SELECT * FROM dog, LATERAL (SELECT * FROM raw_logs) r", "SELECT", []string{"dog", "raw_logs"}},
+		{"union", "SELECT * FROM dog UNION SELECT * FROM raw_logs", "SELECT", []string{"dog", "raw_logs"}},
+		{"union table", "SELECT * FROM dog UNION TABLE raw_logs", "SELECT", []string{"dog", "raw_logs"}},
+		{"table statement", "TABLE raw_logs", "TABLE", []string{"raw_logs"}},
+		{"parenthesized table statement", "(TABLE raw_logs)", "TABLE", []string{"raw_logs"}},
+		{"derived table statement", "SELECT * FROM (TABLE raw_logs) AS t", "SELECT", []string{"raw_logs"}},
+		{"table in a subquery", "SELECT * FROM dog WHERE id IN (TABLE raw_logs)", "SELECT", []string{"dog", "raw_logs"}},
+		{"function with FROM", "SELECT EXTRACT(YEAR FROM time), id FROM dog", "SELECT", []string{"dog"}},
+		{"ordering and limit", "SELECT * FROM dog, cat ORDER BY a, b LIMIT 1, 2", "SELECT", []string{"dog", "cat"}},
+		{"common table expression", "WITH recent AS (SELECT * FROM dog) SELECT * FROM recent", "SELECT", []string{"dog"}},
+		{"duplicates", "SELECT * FROM dog JOIN DOG ON 1 = 1", "SELECT", []string{"dog"}},
+		{"describe", "DESC dog", "DESCRIBE", []string{"dog"}},
+		{"update", "UPDATE dog JOIN cat ON 1 = 1, raw_logs SET a = 1, b = 2", "UPDATE", []string{"dog", "cat", "raw_logs"}},
+		{"insert", "INSERT INTO dog (a, b) VALUES (1, 2)", "INSERT", []string{"dog"}},
+		{"drop", "DROP TABLE IF EXISTS dog", "DROP", []string{"dog"}},
+	}
+
+	for _, test := range tests {
+		statement, err := parseSQL(test.query)
+		if err != nil {
+			t.Errorf("%s: parsing %q failed: %s", test.name, test.query, err)
+			continue
+		}
+		if statement.Type != test.typ {
+			t.Errorf("%s: got type %s, expected %s", test.name, statement.Type, test.typ)
+		}
+		if !reflect.DeepEqual(statement.Tables, test.tables) {
+			t.Errorf("%s: got tables %q, expected %q", test.name, statement.Tables, test.tables)
+		}
+	}
+}
+
+func TestParseSQLErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		message  string
+		position int
+	}{
+		{"empty", "  ", "empty query", 0},
+		{"only a comment", "-- nothing", "empty query", 0},
+		{"executable comment", "SELECT /*! * FROM raw_logs */ 1", "executable comments and optimizer hints are not supported", 7},
+		{"mariadb executable comment", "SELECT * FROM dog /*M!100100 , raw_logs */", "executable comments and optimizer hints are not supported", 18},
+		{"optimizer hint", "SELECT /*+ BKA(dog) */ * FROM dog", "executable comments and optimizer hints are not supported", 7},
+		{"unterminated comment", "SELECT 1 /* FROM dog", "unterminated comment", 9},
+		{"unterminated string", "SELECT 'abc FROM dog", "unterminated string", 7},
+		{"unterminated identifier", "SELECT * FROM `dog", "unterminated quoted identifier", 14},
+		{"unclosed parenthesis", "SELECT (1 FROM dog", "unclosed parenthesis", 7},
+		{"unexpected parenthesis", "SELECT 1) FROM dog", "unexpected closing parenthesis", 8},
+		{"second statement", "SELECT * FROM dog; DROP TABLE dog", "only a single statement can be run per query", 19},
+		{"missing table", "SELECT * FROM", "expected a table name", 13},
+		{"reserved word as table", "SELECT * FROM WHERE", "expected a table name", 14},
+	}
+
+	for _, test := range tests {
+		_, err := parseSQL(test.query)
+		parseErr, ok := err.(*sqlError)
+		if !ok {
+			t.Errorf("%s: expected a sqlError for %q, got %v", test.name, test.query, err)
+			continue
+		}
+		if parseErr.Message != test.message || parseErr.Position != test.position {
+			t.Errorf("%s: got %q at %d, expected %q at %d", test.name, parseErr.Message, parseErr.Position, test.message, test.position)
+		}
+	}
+}
+
+func TestAuthorizeQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		// denied is empty for a query that is allowed
+		denied string
+	}{
+		{"SELECT * FROM dog", ""},
+		{"SELECT sleep FROM dog", ""},
+		{"SELECT `sleep` FROM dog", ""},
+		{"DELETE FROM dog", "DELETE statements are not allowed, only SELECT"},
+		{"SELECT * FROM dog INTO OUTFILE '/tmp/dog'", "SELECT ... INTO is not allowed"},
+		{"SELECT * FROM dog FOR UPDATE", "locking reads are not allowed"},
+		{"SELECT load_file('/etc/passwd') FROM dog", "the LOAD_FILE function is not allowed"},
+		{"SELECT `load_file`('/etc/passwd') FROM dog", "the LOAD_FILE function is not allowed"},
+		{"SELECT `sleep`(100) FROM dog", "the SLEEP function is not allowed"},
+		{"SELECT `BENCHMARK`(1000000, MD5('x')) FROM dog", "the BENCHMARK function is not allowed"},
+		{"SELECT `get_lock`('x', 10) FROM dog", "the GET_LOCK function is not allowed"},
+		{"SELECT * FROM other.dog", "other.dog is not a family; tables in other databases can't be queried"},
+	}
+
+	for _, test := range tests {
+		statement, err := parseSQL(test.query)
+		if err != nil {
+			t.Errorf("parsing %q failed: %s", test.query, err)
+			continue
+		}
+		err = authorizeQuery(statement)
+		switch {
+		case test.denied == "" && err != nil:
+			t.Errorf("%q was denied: %s", test.query, err)
+		case test.denied != "" && (err == nil || err.Error() != test.denied):
+			t.Errorf("%q: got %v, expected %q", test.query, err, test.denied)
+		}
+	}
+}
+
+func TestSQLErrorPosition(t *testing.T) {
+	_, err := parseSQL("SELECT *\nFROM dog;\n  DROP TABLE dog")
+	parseErr, ok := err.(*sqlError)
+	if !ok {
+		t.Fatalf("expected a sqlError, got %v", err)
+	}
+	if parseErr.Line != 3 || parseErr.Column != 3 || parseErr.Near != "DROP TABLE dog" {
+		t.Errorf("got line %d column %d near %q, expected line 3 column 3 near \"DROP TABLE dog\"", parseErr.Line, parseErr.Column, parseErr.Near)
+	}
+}
+
+func TestTokenizeDepth(t *testing.T) {
+	tokens, err := tokenize("a (b (c)) d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	depths := map[string]int{}
+	for _, token := range tokens {
+		if token.Kind == tokenWord {
+			depths[token.Text] = token.Depth
+		}
+	}
+	expected := map[string]int{"a": 0, "b": 1, "c": 2, "d": 0}
+	if !reflect.DeepEqual(depths, expected) {
+		t.Errorf("got depths %v, expected %v", depths, expected)
+	}
+}
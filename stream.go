@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The formats /api/query can stream its results in
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+)
+
+// queryErrorTrailer is the HTTP trailer set when a query fails after its
+// results have started streaming and the status code can't change any more
+const queryErrorTrailer = "X-Query-Error"
+
+// nextCursorTrailer is the HTTP trailer carrying the cursor of the next page
+// of a paginated query
+const nextCursorTrailer = "X-Next-Cursor"
+
+// flushEvery is how many rows are buffered before they are flushed to the
+// client
+const flushEvery = 100
+
+// negotiateFormat picks the result format from the format field of the
+// request or, when that is empty, from the Accept header
+func negotiateFormat(c *gin.Context, requested string) (string, error) {
+	switch strings.ToLower(requested) {
+	case formatJSON, formatNDJSON, formatCSV:
+		return strings.ToLower(requested), nil
+	case "":
+	default:
+		return "", fmt.Errorf("unsupported format %s, use json, ndjson or csv", requested)
+	}
+
+	for _, accepted := range strings.Split(c.Request.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.Split(accepted, ";")[0])
+		switch mediaType {
+		case "application/x-ndjson", "application/ndjson", "application/jsonlines":
+			return formatNDJSON, nil
+		case "text/csv":
+			return formatCSV, nil
+		case "application/json", "*/*", "":
+			return formatJSON, nil
+		}
+	}
+
+	return "", fmt.Errorf("none of the accepted formats are supported, use application/json, application/x-ndjson or text/csv")
+}
+
+// rowWriter writes query results to the client as they are produced
+type rowWriter interface {
+	// Begin is called once with the result columns before any rows
+	Begin(columns []resultColumn) error
+	Row(row []interface{}) error
+	// End is called once after the last row with the final column types
+	End(columns []resultColumn, end resultEnd) error
+}
+
+// resultEnd is what a rowWriter is told once the last row has been written
+type resultEnd struct {
+	// Err cut the results short, if set
+	Err error
+	// NextCursor continues a paginated query and is empty on its last page
+	NextCursor string
+}
+
+// streamWriter holds what every rowWriter needs to stream a response
+type streamWriter struct {
+	c       *gin.Context
+	out     *bufio.Writer
+	pending int
+}
+
+// begin sends the headers of a streamed response
+func (s *streamWriter) begin(contentType string) {
+	header := s.c.Writer.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Trailer", queryErrorTrailer+", "+nextCursorTrailer)
+	s.c.Status(http.StatusAccepted)
+	s.out = bufio.NewWriter(s.c.Writer)
+}
+
+// rowWritten flushes the rows written so far every flushEvery rows
+func (s *streamWriter) rowWritten() error {
+	s.pending++
+	if s.pending < flushEvery {
+		return nil
+	}
+	s.pending = 0
+	return s.flush()
+}
+
+func (s *streamWriter) flush() error {
+	err := s.out.Flush()
+	if err != nil {
+		return err
+	}
+	s.c.Writer.Flush()
+	return nil
+}
+
+// end flushes the rest of the response, setting the trailers
+func (s *streamWriter) end(end resultEnd) error {
+	if end.Err != nil {
+		s.c.Writer.Header().Set(queryErrorTrailer, end.Err.Error())
+	}
+	if end.NextCursor != "" {
+		s.c.Writer.Header().Set(nextCursorTrailer, end.NextCursor)
+	}
+	return s.flush()
+}
+
+// newRowWriter returns the rowWriter for a negotiated format
+func newRowWriter(c *gin.Context, format string) rowWriter {
+	switch format {
+	case formatNDJSON:
+		return &ndjsonWriter{streamWriter: streamWriter{c: c}}
+	case formatCSV:
+		return &csvWriter{streamWriter: streamWriter{c: c}}
+	}
+	return &jsonWriter{streamWriter: streamWriter{c: c}}
+}
+
+// jsonWriter streams the {"result": [...], "columns": [...]} envelope. The
+// columns come last because their types are only final once every row has
+// been seen.
+type jsonWriter struct {
+	streamWriter
+	columns []resultColumn
+	rows    int
+}
+
+func (w *jsonWriter) Begin(columns []resultColumn) error {
+	w.columns = columns
+	w.begin("application/json; charset=utf-8")
+	_, err := io.WriteString(w.out, `{"result":[`)
+	return err
+}
+
+func (w *jsonWriter) Row(row []interface{}) error {
+	if w.rows > 0 {
+		w.out.WriteByte(',')
+	}
+	w.rows++
+	err := writeRowObject(w.out, w.columns, row)
+	if err != nil {
+		return err
+	}
+	return w.rowWritten()
+}
+
+func (w *jsonWriter) End(columns []resultColumn, end resultEnd) error {
+	encodedColumns, _ := json.Marshal(columns)
+	fmt.Fprintf(w.out, `],"columns":%s`, encodedColumns)
+	if end.NextCursor != "" {
+		encodedCursor, _ := json.Marshal(end.NextCursor)
+		fmt.Fprintf(w.out, `,"next_cursor":%s`, encodedCursor)
+	}
+	if end.Err != nil {
+		encodedErr, _ := json.Marshal(end.Err.Error())
+		fmt.Fprintf(w.out, `,"error":%s`, encodedErr)
+	}
+	w.out.WriteByte('}')
+	return w.end(end)
+}
+
+// ndjsonWriter streams every row as a JSON object on a line of its own. A
+// query failing part way through ends with an {"error": "..."} line and a
+// page of a paginated query with a {"next_cursor": "..."} line.
+type ndjsonWriter struct {
+	streamWriter
+	columns []resultColumn
+}
+
+func (w *ndjsonWriter) Begin(columns []resultColumn) error {
+	w.columns = columns
+	w.begin("application/x-ndjson")
+	return nil
+}
+
+func (w *ndjsonWriter) Row(row []interface{}) error {
+	err := writeRowObject(w.out, w.columns, row)
+	if err != nil {
+		return err
+	}
+	w.out.WriteByte('\n')
+	return w.rowWritten()
+}
+
+func (w *ndjsonWriter) End(columns []resultColumn, end resultEnd) error {
+	if end.Err != nil {
+		encodedErr, _ := json.Marshal(end.Err.Error())
+		fmt.Fprintf(w.out, "{\"error\":%s}\n", encodedErr)
+	} else if end.NextCursor != "" {
+		encodedCursor, _ := json.Marshal(end.NextCursor)
+		fmt.Fprintf(w.out, "{\"next_cursor\":%s}\n", encodedCursor)
+	}
+	return w.end(end)
+}
+
+// csvWriter streams a header row of column names followed by the rows. A
+// query failing part way through and the cursor of the next page are only
+// reported by the trailers.
+type csvWriter struct {
+	streamWriter
+	csv *csv.Writer
+}
+
+func (w *csvWriter) Begin(columns []resultColumn) error {
+	w.begin("text/csv; charset=utf-8")
+	w.csv = csv.NewWriter(w.out)
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name
+	}
+	return w.csv.Write(names)
+}
+
+func (w *csvWriter) Row(row []interface{}) error {
+	record := make([]string, len(row))
+	for i, value := range row {
+		record[i] = csvValue(value)
+	}
+	err := w.csv.Write(record)
+	if err != nil {
+		return err
+	}
+	// Only moves the record into our own buffer, which rowWritten flushes
+	w.csv.Flush()
+	return w.rowWritten()
+}
+
+func (w *csvWriter) End(columns []resultColumn, end resultEnd) error {
+	w.csv.Flush()
+	return w.end(end)
+}
+
+// writeRowObject writes a row as a JSON object keyed by column name, keeping
+// the columns in the order of the result
+func writeRowObject(out *bufio.Writer, columns []resultColumn, row []interface{}) error {
+	out.WriteByte('{')
+	for i, value := range row {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		name, _ := json.Marshal(columns[i].Name)
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		out.Write(name)
+		out.WriteByte(':')
+		out.Write(encoded)
+	}
+	return out.WriteByte('}')
+}
+
+// csvValue formats a single value for a CSV record, with NULL as an empty field
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case json.RawMessage:
+		return string(v)
+	}
+	return fmt.Sprint(value)
+}
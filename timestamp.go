@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventTimestampKey is the reserved key a producer can put in any log event to
+// set its time without declaring a timestamp field in the schema
+const eventTimestampKey = "@timestamp"
+
+// The timestamp formats a producer can declare in IngestLogBody. Anything else
+// is treated as a Go reference time layout such as "2006-01-02 15:04:05".
+const (
+	timestampRFC3339 = "rfc3339"
+	timestampUnix    = "unix"
+	timestampUnixMs  = "unix_ms"
+)
+
+// validateTimestamp checks the timestamp options of an ingest request and
+// returns a map of option name to error message for everything that is wrong
+func validateTimestamp(body IngestLogBody) map[string]string {
+	fieldErrors := map[string]string{}
+
+	if body.TimestampField != "" {
+		if _, ok := body.Schema[body.TimestampField]; !ok {
+			fieldErrors["timestamp_field"] = fmt.Sprintf(
+				"The timestamp field %s was not specified in the %s schema map",
+				body.TimestampField,
+				body.Family,
+			)
+		}
+	}
+
+	switch strings.ToLower(body.TimestampFormat) {
+	case "", timestampRFC3339, timestampUnix, timestampUnixMs:
+	default:
+		// A layout without any reference time elements in it formats every
+		// time the same way, so it can't be what the producer meant
+		layout := body.TimestampFormat
+		if time.Unix(0, 0).UTC().Format(layout) == layout {
+			fieldErrors["timestamp_format"] = fmt.Sprintf("%q is not a supported timestamp format", layout)
+		}
+	}
+
+	return fieldErrors
+}
+
+// eventTime works out the time of a single log event. The reserved
+// @timestamp key wins, then the field named by timestamp_field, and events
+// carrying neither are stamped with the time the request was received.
+func eventTime(body IngestLogBody, logEvent map[string]interface{}, received time.Time) (time.Time, error) {
+	value, ok := logEvent[eventTimestampKey]
+	if !ok && body.TimestampField != "" {
+		value, ok = logEvent[body.TimestampField]
+	}
+	if !ok || value == nil {
+		return received, nil
+	}
+
+	return parseTimestamp(value, body.TimestampFormat)
+}
+
+// parseTimestamp parses a decoded JSON value according to a declared
+// timestamp format
+func parseTimestamp(value interface{}, format string) (time.Time, error) {
+	switch strings.ToLower(format) {
+	case "", timestampRFC3339:
+		s, ok := value.(string)
+		if !ok {
+			return time.Time{}, fmt.Errorf("expected an RFC3339 time but got %T", value)
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("expected an RFC3339 time but got %q", s)
+		}
+		return t, nil
+	case timestampUnix, timestampUnixMs:
+		var n float64
+		switch v := value.(type) {
+		case float64:
+			n = v
+		case string:
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("expected a %s time but got %q", format, v)
+			}
+			n = parsed
+		default:
+			return time.Time{}, fmt.Errorf("expected a %s time but got %T", format, value)
+		}
+		if strings.ToLower(format) == timestampUnixMs {
+			n = n / 1000
+		}
+		seconds, fraction := math.Modf(n)
+		return time.Unix(int64(seconds), int64(fraction*1e9)), nil
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("expected a time in the format %q but got %T", format, value)
+	}
+	t, err := time.ParseInLocation(format, s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected a time in the format %q but got %q", format, s)
+	}
+	return t, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/units"
+	"gopkg.in/yaml.v2"
+)
+
+// ShardConfig describes a single shard of the topology. Only the address and
+// database have to be given.
+type ShardConfig struct {
+	// ID names the shard in the catalog and the admin API, and defaults to
+	// address/database
+	ID       string `yaml:"id" json:"id"`
+	Address  string `yaml:"address" json:"address" binding:"required"`
+	Database string `yaml:"database" json:"database" binding:"required"`
+	// Username and Password default to --mysql_username and
+	// --mysql_password, and ReadUsername and ReadPassword to
+	// --mysql_read_username and --mysql_read_password
+	Username     string `yaml:"username" json:"username"`
+	Password     string `yaml:"password" json:"password"`
+	ReadUsername string `yaml:"read_username" json:"read_username"`
+	ReadPassword string `yaml:"read_password" json:"read_password"`
+	// Params are added to the connection string, such as tls or timeout
+	Params map[string]string `yaml:"params" json:"params"`
+	// Weight and Capacity work like --shard_weight and --shard_capacity,
+	// which take precedence over them
+	Weight   float64 `yaml:"weight" json:"weight"`
+	Capacity string  `yaml:"capacity" json:"capacity"`
+	// Tags label the shard, such as with its region or tier
+	Tags map[string]string `yaml:"tags" json:"tags"`
+}
+
+// topologyFile is the format of --shards_file
+type topologyFile struct {
+	Shards []ShardConfig `yaml:"shards"`
+}
+
+// fixedParams are the connection string parameters the service depends on,
+// which Params can't change
+var fixedParams = map[string]string{
+	"charset":   "utf8",
+	"parseTime": "True",
+	"loc":       "Local",
+}
+
+// loadTopology returns the configured shards, read from --shards_file when it
+// is given, then from the shards of --config unless --mysql_address or
+// --mysql_databases are given, and otherwise made up of every combination of
+// --mysql_address and --mysql_databases
+func loadTopology() ([]ShardConfig, error) {
+	var shards []ShardConfig
+	if *shardsFile != "" {
+		contents, err := ioutil.ReadFile(*shardsFile)
+		if err != nil {
+			return nil, err
+		}
+		// JSON is valid YAML, so this reads both
+		var file topologyFile
+		err = yaml.Unmarshal(contents, &file)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", *shardsFile, err)
+		}
+		shards = file.Shards
+	} else if len(loadedConfig.Shards) > 0 && !userFlags["mysql_address"] && !userFlags["mysql_databases"] {
+		shards = append([]ShardConfig(nil), loadedConfig.Shards...)
+	} else {
+		for _, address := range strings.Split(*dbAddress, ",") {
+			for _, database := range strings.Split(*dbName, ",") {
+				shards = append(shards, ShardConfig{Address: address, Database: database})
+			}
+		}
+	}
+
+	for i := range shards {
+		shards[i] = shards[i].withDefaults()
+	}
+	return shards, validateTopology(shards)
+}
+
+// withDefaults fills in the ID and credentials of a shard that weren't given
+func (config ShardConfig) withDefaults() ShardConfig {
+	if config.ID == "" {
+		config.ID = config.Address + "/" + config.Database
+	}
+	if config.Username == "" {
+		config.Username, config.Password = *dbUsername, *dbPassword
+	}
+	if config.ReadUsername == "" {
+		config.ReadUsername, config.ReadPassword = *dbReadUsername, *dbReadPassword
+	}
+	return config
+}
+
+// validateTopology checks the configured shards, which must have had their
+// defaults filled in
+func validateTopology(shards []ShardConfig) error {
+	if len(shards) == 0 {
+		return fmt.Errorf("no shards are configured")
+	}
+	seen := map[string]bool{}
+	for i, config := range shards {
+		if config.Address == "" || config.Database == "" {
+			return fmt.Errorf("shard %d needs both an address and a database", i)
+		}
+		if seen[config.ID] {
+			return fmt.Errorf("more than one shard has the ID %s", config.ID)
+		}
+		seen[config.ID] = true
+		for param := range config.Params {
+			if _, ok := fixedParams[param]; ok {
+				return fmt.Errorf("the %s parameter of %s can't be changed", param, config.ID)
+			}
+		}
+		_, _, err := shardSizing(config)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dsn returns the connection string of the shard for the given user
+func (config ShardConfig) dsn(username string, password string) string {
+	params := url.Values{}
+	for param, value := range config.Params {
+		params.Set(param, value)
+	}
+	for param, value := range fixedParams {
+		params.Set(param, value)
+	}
+	// Without a dial timeout, connecting to a shard that has gone away can
+	// hang for as long as the operating system lets it
+	if params.Get("timeout") == "" {
+		params.Set("timeout", healthTimeout.String())
+	}
+	return fmt.Sprintf("%s:%s@(%s)/%s?%s", username, password, config.Address, config.Database, params.Encode())
+}
+
+// shardSizing works out the weight and capacity of a shard from its config
+// and --shard_weight and --shard_capacity
+func shardSizing(config ShardConfig) (weight float64, capacity int64, err error) {
+	id := config.ID
+	weight = 1
+	if config.Weight < 0 {
+		return 0, 0, fmt.Errorf("the weight of %s must be a positive number, not %v", id, config.Weight)
+	}
+	if config.Weight > 0 {
+		weight = config.Weight
+	}
+	if config.Capacity != "" {
+		size, err := units.ParseBase2Bytes(config.Capacity)
+		if err != nil || size <= 0 {
+			return 0, 0, fmt.Errorf("the capacity of %s must be a size such as 500GB, not %q", id, config.Capacity)
+		}
+		capacity = int64(size)
+	}
+
+	if value, ok := (*shardWeights)[id]; ok {
+		weight, err = strconv.ParseFloat(value, 64)
+		if err != nil || weight <= 0 {
+			return 0, 0, fmt.Errorf("the weight of %s must be a positive number, not %q", id, value)
+		}
+	}
+	if value, ok := (*shardCapacities)[id]; ok {
+		size, err := units.ParseBase2Bytes(value)
+		if err != nil || size <= 0 {
+			return 0, 0, fmt.Errorf("the capacity of %s must be a size such as 500GB, not %q", id, value)
+		}
+		capacity = int64(size)
+	}
+	return weight, capacity, nil
+}